@@ -0,0 +1,249 @@
+package broker
+
+import (
+	"fmt"
+	"goodyear/logging"
+	"os"
+)
+
+type UserConfig struct {
+	Passcode string   `json:"passcode"`
+	Groups   []string `json:"groups"`
+}
+
+// ACLRule grants permissions ("read", "write" or "admin") on the
+// destinations matching a pattern, to a principal or to everyone in a
+// group.  A principal of "*" means anyone, logged in or not.  Patterns
+// can use "*" to match any run of characters.
+type ACLRule struct {
+	Principal   string   `json:"principal"`
+	Group       string   `json:"group"`
+	Destination string   `json:"destination"`
+	Permissions []string `json:"permissions"`
+}
+
+const (
+	permRead  = "read"
+	permWrite = "write"
+	permAdmin = "admin"
+)
+
+// accessControl is the part of the config that can be reloaded without
+// a restart.  With no users configured anyone can connect anonymously,
+// and with no rules anyone can do anything.
+type accessControl struct {
+	users map[string]UserConfig
+	rules []ACLRule
+}
+
+func newAccessControl(c *Config) (*accessControl, error) {
+	ac := &accessControl{}
+	ac.users = c.Users
+	ac.rules = c.ACLs
+
+	for _, r := range ac.rules {
+		if (r.Principal == "") == (r.Group == "") {
+			return nil, fmt.Errorf("acl for '%s' needs exactly one of a principal or a group", r.Destination)
+		}
+
+		// Nobody can log in as a principal without users to check
+		// them against.
+		if len(ac.users) == 0 && r.Principal != "*" {
+			return nil, fmt.Errorf("acl for '%s' names a principal or group, but there are no users", r.Destination)
+		}
+
+		for _, p := range r.Permissions {
+			if p != permRead && p != permWrite && p != permAdmin {
+				return nil, fmt.Errorf("unknown permission '%s'", p)
+			}
+		}
+	}
+
+	return ac, nil
+}
+
+// authenticate checks a login and returns the principal it's for.
+// With no users configured anyone gets in, but as nobody in
+// particular, since there's nothing to check the login against.
+func (ac *accessControl) authenticate(login, passcode string) (string, bool) {
+	if len(ac.users) == 0 {
+		return "", true
+	}
+
+	u, exists := ac.users[login]
+	if !exists || u.Passcode != passcode {
+		return "", false
+	}
+
+	return login, true
+}
+
+func (ac *accessControl) inGroup(principal, group string) bool {
+	for _, g := range ac.users[principal].Groups {
+		if g == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ac *accessControl) allowed(principal, perm, dst string) bool {
+	return len(ac.rules) == 0 || ac.granted(principal, perm, dst)
+}
+
+// granted says whether a rule gives a principal a permission, without
+// the free-for-all when there aren't any rules.
+func (ac *accessControl) granted(principal, perm, dst string) bool {
+	for _, r := range ac.rules {
+		switch {
+		case r.Principal == "*":
+		case r.Principal != "" && r.Principal == principal:
+		case r.Group != "" && principal != "" && ac.inGroup(principal, r.Group):
+		default:
+			continue
+		}
+
+		if !matchPattern(r.Destination, dst) {
+			continue
+		}
+
+		for _, p := range r.Permissions {
+			if p == perm {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchPattern is a glob match where "*" matches anything, including
+// slashes and dots.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == '*' {
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(s) == 0 || s[0] != pattern[0] {
+			return false
+		}
+
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+
+	return len(s) == 0
+}
+
+func (b *Broker) setAccessControl(ac *accessControl) {
+	b.access.Store(ac)
+}
+
+func (b *Broker) getAccessControl() *accessControl {
+	ac, _ := b.access.Load().(*accessControl)
+	if ac == nil {
+		return &accessControl{}
+	}
+
+	return ac
+}
+
+// setAuditFile sends the audit log to a file, or to stderr if f is nil.
+func (b *Broker) setAuditFile(f *os.File) {
+	b.auditLock.Lock()
+	defer b.auditLock.Unlock()
+
+	if f == nil {
+		b.auditLog.SetOutput(os.Stderr)
+	} else {
+		b.auditLog.SetOutput(f)
+	}
+
+	if b.auditFile != nil {
+		b.auditFile.Close()
+	}
+	b.auditFile = f
+}
+
+// authorize checks a principal's permission on a destination, and
+// records the decision in the audit log.
+func (b *Broker) authorize(connId int, principal, perm, dst string) error {
+	ac := b.getAccessControl()
+	if len(ac.rules) == 0 {
+		return nil
+	}
+
+	allowed := ac.allowed(principal, perm, dst)
+
+	who := principal
+	if who == "" {
+		who = "anonymous"
+	}
+
+	decision := "deny"
+	if allowed {
+		decision = "allow"
+	}
+
+	b.auditLog.Printf("%s conn=%d principal=%s perm=%s dest=%s", decision, connId, who, perm, dst)
+
+	if !allowed {
+		return fmt.Errorf("%s is not allowed to %s '%s'", who, perm, dst)
+	}
+
+	return nil
+}
+
+// Reload swaps in the users, rules, audit log, tracing and limits
+// from a config, along with any log levels it sets, without touching
+// anything else.  Log levels are shared by every broker in the
+// process.  If anything in the config is bad, nothing is changed.
+func (b *Broker) Reload(c *Config) error {
+	ac, err := newAccessControl(c)
+	if err != nil {
+		return err
+	}
+
+	var af *os.File
+	if c.AuditLog != "" {
+		af, err = os.OpenFile(c.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	tf, err := openTraceFile(c)
+	if err != nil {
+		if af != nil {
+			af.Close()
+		}
+		return err
+	}
+
+	// SetLevels checks every level before it changes any of them, so
+	// it goes last.
+	if err := logging.SetLevels(c.LogLevels); err != nil {
+		if af != nil {
+			af.Close()
+		}
+		if tf != nil {
+			tf.Close()
+		}
+		return err
+	}
+
+	b.setAuditFile(af)
+	b.setAccessControl(ac)
+	b.setTracing(newTraceSettings(c), tf)
+	b.setLimits(newLimitSettings(c))
+
+	return nil
+}
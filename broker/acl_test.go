@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"/queue/orders", "/queue/orders", true},
+		{"/queue/orders", "/queue/orders.eu", false},
+		{"/queue/*", "/queue/orders", true},
+		{"/queue/*", "/topic/orders", false},
+		{"*.audit", "/topic/orders.audit", true},
+		{"/queue/*.eu", "/queue/orders.us", false},
+		{"*", "", true},
+	}
+
+	for _, c := range cases {
+		if matchPattern(c.pattern, c.s) != c.match {
+			t.Errorf("'%s' against '%s' should be %v", c.pattern, c.s, c.match)
+		}
+	}
+}
+
+func testAccessControl(t *testing.T) *accessControl {
+	c := &Config{}
+	c.Users = map[string]UserConfig{
+		"alice": {Passcode: "secret", Groups: []string{"ops"}},
+		"bob":   {Passcode: "hunter2"},
+	}
+	c.ACLs = []ACLRule{
+		{Group: "ops", Destination: "*", Permissions: []string{"read", "write", "admin"}},
+		{Principal: "bob", Destination: "/queue/bob.*", Permissions: []string{"read"}},
+		{Principal: "*", Destination: "/topic/public", Permissions: []string{"read"}},
+	}
+
+	ac, err := newAccessControl(c)
+	if err != nil {
+		t.Error("access control didn't load", err)
+		t.FailNow()
+	}
+
+	return ac
+}
+
+func TestAccessControl(t *testing.T) {
+	ac := testAccessControl(t)
+
+	if p, ok := ac.authenticate("alice", "secret"); !ok || p != "alice" {
+		t.Error("alice should be able to log in", p)
+	}
+
+	if _, ok := ac.authenticate("alice", "wrong"); ok {
+		t.Error("a wrong passcode should fail")
+	}
+
+	if _, ok := ac.authenticate("eve", ""); ok {
+		t.Error("unknown users should fail")
+	}
+
+	cases := []struct {
+		principal, perm, dst string
+		allowed              bool
+	}{
+		{"alice", "write", "/queue/anything", true},
+		{"bob", "read", "/queue/bob.inbox", true},
+		{"bob", "write", "/queue/bob.inbox", false},
+		{"bob", "read", "/queue/alice.inbox", false},
+		{"", "read", "/topic/public", true},
+		{"", "write", "/topic/public", false},
+	}
+
+	for _, c := range cases {
+		if ac.allowed(c.principal, c.perm, c.dst) != c.allowed {
+			t.Errorf("%s %s %s should be %v", c.principal, c.perm, c.dst, c.allowed)
+		}
+	}
+
+	if _, err := newAccessControl(&Config{ACLs: []ACLRule{{Destination: "*"}}}); err == nil {
+		t.Error("rules need a principal or group")
+	}
+
+	if _, err := newAccessControl(&Config{ACLs: []ACLRule{{Principal: "*", Permissions: []string{"fly"}}}}); err == nil {
+		t.Error("unknown permissions should be refused")
+	}
+
+	if _, err := newAccessControl(&Config{ACLs: []ACLRule{{Principal: "alice", Destination: "*", Permissions: []string{"read"}}}}); err == nil {
+		t.Error("principals need users to log in as")
+	}
+
+	if _, err := newAccessControl(&Config{ACLs: []ACLRule{{Principal: "*", Destination: "*", Permissions: []string{"read"}}}}); err != nil {
+		t.Error("rules for anyone don't need users", err)
+	}
+}
+
+func TestAccessDenied(t *testing.T) {
+	s := newSimpleSeq(t)
+	s.cs.broker.setAccessControl(testAccessControl(t))
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2", "login": "bob", "passcode": "hunter2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("SEND", hdr{"destination": "/queue/bob.inbox"}, "")
+	s.Expect("ERROR")
+	s.Send("DISCONNECT", hdr{}, "")
+	s.Finish()
+}
+
+func TestLoginFailed(t *testing.T) {
+	s := newSimpleSeq(t)
+	s.cs.broker.setAccessControl(testAccessControl(t))
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2", "login": "bob", "passcode": "wrong"}, "")
+	f := s.Expect("ERROR")
+	if strings.Contains(string(f.Body), "wrong") {
+		t.Error("the ERROR shouldn't repeat the passcode")
+	}
+	s.Finish()
+}
+
+func TestLoginWithoutUsers(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2", "login": "alice", "passcode": "anything"}, "")
+	s.Expect("CONNECTED")
+
+	s.cs.infoLock.Lock()
+	p := s.cs.principal
+	s.cs.infoLock.Unlock()
+
+	if p != "" {
+		t.Error("nobody should be trusted to be", p)
+	}
+
+	s.Send("DISCONNECT", hdr{}, "")
+	s.Finish()
+}
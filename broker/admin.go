@@ -0,0 +1,445 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"goodyear/dest"
+	"goodyear/frame"
+	"goodyear/logging"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The largest message body the admin API will send.
+const maxAdminBody = 1 << 20
+
+type adminSub struct {
+	Id          string `json:"id"`
+	Destination string `json:"destination"`
+	Ack         string `json:"ack"`
+	Prefetch    int    `json:"prefetch"`
+	Unacked     int    `json:"unacked"`
+}
+
+type adminConn struct {
+	Id            int        `json:"id"`
+	Remote        string     `json:"remote"`
+	Listener      string     `json:"listener"`
+	Principal     string     `json:"principal"`
+	Phase         string     `json:"phase"`
+	Traced        bool       `json:"traced"`
+	Subscriptions []adminSub `json:"subscriptions"`
+}
+
+type adminSubStats struct {
+	Subscription string `json:"subscription"`
+	Queued       int    `json:"queued"`
+	Dropped      uint64 `json:"dropped"`
+}
+
+type adminDest struct {
+	dest.DestInfo
+
+	// Which subscription each message group is pinned to, for
+	// queues, and how each subscriber is keeping up, for topics.
+	Groups          map[string]string `json:"groups,omitempty"`
+	SubscriberStats []adminSubStats   `json:"subscriber-stats,omitempty"`
+}
+
+func (cs *clientState) adminInfo() adminConn {
+	cs.infoLock.Lock()
+	defer cs.infoLock.Unlock()
+
+	c := adminConn{
+		Id:            cs.id,
+		Remote:        cs.remote,
+		Listener:      cs.listener,
+		Principal:     cs.principal,
+		Phase:         cs.getPhase().String(),
+		Traced:        cs.trace.enabled(),
+		Subscriptions: []adminSub{},
+	}
+
+	for _, sub := range cs.subs {
+		c.Subscriptions = append(c.Subscriptions, adminSub{
+			Id:          sub.id,
+			Destination: string(sub.dest),
+			Ack:         sub.ackMode.String(),
+			Prefetch:    sub.prefetch,
+			Unacked:     sub.outstanding(),
+		})
+	}
+
+	sort.Slice(c.Subscriptions, func(i, j int) bool {
+		return c.Subscriptions[i].Id < c.Subscriptions[j].Id
+	})
+
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminAllowed checks the request's basic auth credentials against the
+// broker's users, and that the user has the admin permission on dst.
+// Requests that aren't about one destination check against "*", so
+// they need a rule that covers every destination.  The permission has
+// to be granted by a rule even when there are no rules at all, and
+// with no users configured, nobody gets in.
+func (b *Broker) adminAllowed(w http.ResponseWriter, r *http.Request, dst string) bool {
+	ac := b.getAccessControl()
+
+	login, passcode, ok := r.BasicAuth()
+	if ok {
+		login, ok = ac.authenticate(login, passcode)
+	}
+	if !ok || login == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="goodyear"`)
+		http.Error(w, "login required", http.StatusUnauthorized)
+		return false
+	}
+
+	allowed := ac.granted(login, permAdmin, dst)
+
+	decision := "deny"
+	if allowed {
+		decision = "allow"
+	}
+
+	// Looking isn't worth recording, but changing things is.
+	if !allowed || r.Method != http.MethodGet {
+		b.auditLog.Printf("%s admin principal=%s request=%s %s dest=%s", decision, login, r.Method, r.URL.Path, dst)
+	}
+
+	if !allowed {
+		http.Error(w, fmt.Sprintf("%s is not allowed to administer '%s'", login, dst), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// AdminHandler serves the admin HTTP API.  Everything is JSON, and
+// destinations are named by the "name" query parameter.
+//
+//	GET    /connections              connections and their subscriptions
+//	DELETE /connections/<id>         disconnect a client
+//	GET    /connections/<id>/trace   frames recorded for a client
+//	POST   /connections/<id>/trace   start tracing a client
+//	DELETE /connections/<id>/trace   stop tracing a client
+//	GET    /destinations?prefix=     destinations, optionally by prefix
+//	GET    /destinations/info        one destination in more detail
+//	DELETE /destinations             remove a destination
+//	POST   /destinations/purge       throw away a destination's messages
+//	POST   /destinations/send        send the request body as a message
+//	GET    /usage                    memory usage
+//	GET    /scheduled                messages waiting on a delay
+//	DELETE /scheduled/<id>           cancel a scheduled message
+//	GET    /log-levels               log levels by subsystem
+//	POST   /log-levels?subsystem=&level=   change a subsystem's log level
+func (b *Broker) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/connections", methods{"GET": b.adminConnections}.serve)
+	mux.HandleFunc("/connections/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/trace") {
+			methods{"GET": b.adminTrace, "POST": b.adminTraceOn, "DELETE": b.adminTraceOff}.serve(w, r)
+		} else {
+			methods{"DELETE": b.adminKick}.serve(w, r)
+		}
+	})
+	mux.HandleFunc("/destinations", methods{"GET": b.adminDestinations, "DELETE": b.adminRemove}.serve)
+	mux.HandleFunc("/destinations/info", methods{"GET": b.adminDestination}.serve)
+	mux.HandleFunc("/destinations/purge", methods{"POST": b.adminPurge}.serve)
+	mux.HandleFunc("/destinations/send", methods{"POST": b.adminSend}.serve)
+	mux.HandleFunc("/usage", methods{"GET": b.adminUsage}.serve)
+	mux.HandleFunc("/scheduled", methods{"GET": b.adminScheduled}.serve)
+	mux.HandleFunc("/scheduled/", methods{"DELETE": b.adminCancel}.serve)
+	mux.HandleFunc("/log-levels", methods{"GET": b.adminLogLevels, "POST": b.adminSetLogLevel}.serve)
+
+	return mux
+}
+
+// methods picks a handler by request method.
+type methods map[string]http.HandlerFunc
+
+func (m methods) serve(w http.ResponseWriter, r *http.Request) {
+	h, ok := m[r.Method]
+	if !ok {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h(w, r)
+}
+
+func (b *Broker) adminConnections(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	conns := []adminConn{}
+	for _, cs := range b.clients() {
+		conns = append(conns, cs.adminInfo())
+	}
+
+	writeJSON(w, conns)
+}
+
+// adminClient finds the connection named by a /connections/<id>
+// path, or reports why it couldn't.
+func (b *Broker) adminClient(w http.ResponseWriter, r *http.Request) *clientState {
+	path := strings.TrimPrefix(r.URL.Path, "/connections/")
+	id, err := strconv.Atoi(strings.TrimSuffix(path, "/trace"))
+	if err != nil {
+		http.Error(w, "bad connection id", http.StatusBadRequest)
+		return nil
+	}
+
+	for _, cs := range b.clients() {
+		if cs.id == id {
+			return cs
+		}
+	}
+
+	http.Error(w, "no such connection", http.StatusNotFound)
+
+	return nil
+}
+
+func (b *Broker) adminKick(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	if cs := b.adminClient(w, r); cs != nil {
+		cs.disconnect("disconnected by an administrator")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (b *Broker) adminTrace(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	if cs := b.adminClient(w, r); cs != nil {
+		writeJSON(w, cs.trace.frames())
+	}
+}
+
+func (b *Broker) adminTraceOn(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	if cs := b.adminClient(w, r); cs != nil {
+		cs.trace.setEnabled(true)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// adminTraceOff stops recording, but what's been recorded stays around
+// to be looked at.
+func (b *Broker) adminTraceOff(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	if cs := b.adminClient(w, r); cs != nil {
+		cs.trace.setEnabled(false)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (b *Broker) adminDestinations(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	dests := []dest.DestInfo{}
+	for _, id := range dest.List(r.URL.Query().Get("prefix")) {
+		// It might have gone since we listed it.
+		if info, err := dest.Describe(id); err == nil {
+			dests = append(dests, info)
+		}
+	}
+
+	writeJSON(w, dests)
+}
+
+func (b *Broker) adminDestination(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !b.adminAllowed(w, r, name) {
+		return
+	}
+
+	id := dest.DestId(name)
+	info, err := dest.Describe(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	ad := adminDest{DestInfo: info}
+
+	d, _ := dest.Lookup(id)
+	if q, ok := d.(*dest.Queue); ok {
+		ad.Groups = make(map[string]string)
+		for g, s := range q.Groups() {
+			ad.Groups[g] = fmt.Sprint(s)
+		}
+	}
+
+	var bc *dest.Broadcast
+	switch t := d.(type) {
+	case *dest.Broadcast:
+		bc = t
+	case *dest.VirtualTopic:
+		bc = t.Broadcast
+	}
+
+	if bc != nil {
+		for _, st := range bc.Stats() {
+			ad.SubscriberStats = append(ad.SubscriberStats, adminSubStats{fmt.Sprint(st.Sub), st.Queued, st.Dropped})
+		}
+	}
+
+	writeJSON(w, ad)
+}
+
+func (b *Broker) adminRemove(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !b.adminAllowed(w, r, name) {
+		return
+	}
+
+	if err := dest.RemoveDest(dest.DestId(name)); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Broker) adminPurge(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !b.adminAllowed(w, r, name) {
+		return
+	}
+
+	n, err := dest.Purge(dest.DestId(name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, map[string]int{"purged": n})
+}
+
+func (b *Broker) adminSend(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !b.adminAllowed(w, r, name) {
+		return
+	}
+
+	if _, exists := dest.Lookup(dest.DestId(name)); !exists {
+		http.Error(w, "destination doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	f := frame.NewFrame()
+	f.Cmd = "SEND"
+	f.Headers.Add("destination", name)
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		f.Headers.Add("content-type", ct)
+	}
+	f.Headers.Add("content-length", strconv.Itoa(len(body)))
+	f.Body = body
+
+	if err := dest.Send(dest.DestId(name), f); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Broker) adminUsage(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	usage := struct {
+		Global       dest.UsageStats                 `json:"global"`
+		Destinations map[dest.DestId]dest.UsageStats `json:"destinations"`
+		Scheduled    int                             `json:"scheduled"`
+	}{dest.GlobalUsage().Stats(), dest.Usages(), dest.ScheduledCount()}
+
+	writeJSON(w, usage)
+}
+
+func (b *Broker) adminScheduled(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	writeJSON(w, dest.Scheduled())
+}
+
+func (b *Broker) adminCancel(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/scheduled/"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad message id", http.StatusBadRequest)
+		return
+	}
+
+	if err := dest.CancelScheduled(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Broker) adminLogLevels(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	writeJSON(w, logging.Levels())
+}
+
+func (b *Broker) adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAllowed(w, r, "*") {
+		return
+	}
+
+	q := r.URL.Query()
+	l, err := logging.ParseLevel(q.Get("level"))
+	if err == nil {
+		err = logging.SetLevel(q.Get("subsystem"), l)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, logging.Levels())
+}
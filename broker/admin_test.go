@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"goodyear/dest"
+	"goodyear/frame"
+	"goodyear/logging"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, login, body string) *http.Response {
+	req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if login != "" {
+		req.SetBasicAuth(login, "secret")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("admin request failed", err)
+		t.FailNow()
+	}
+
+	return resp
+}
+
+func TestAdmin(t *testing.T) {
+	c := &Config{}
+	c.Destinations = []DestConfig{{Name: "test/admin-queue", Type: "queue"}}
+	c.Users = map[string]UserConfig{
+		"alice": {Passcode: "secret", Groups: []string{"ops"}},
+		"bob":   {Passcode: "secret"},
+	}
+	c.ACLs = []ACLRule{
+		{Group: "ops", Destination: "*", Permissions: []string{"read", "write", "admin"}},
+		{Principal: "bob", Destination: "test/*", Permissions: []string{"read", "write"}},
+	}
+
+	b, l := startBroker(t, c)
+	defer b.Shutdown(context.Background())
+
+	srv := httptest.NewServer(b.AdminHandler())
+	defer srv.Close()
+
+	if resp := adminRequest(t, srv, "GET", "/connections", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("admin requests need a login, got", resp.Status)
+	}
+
+	if resp := adminRequest(t, srv, "GET", "/connections", "bob", ""); resp.StatusCode != http.StatusForbidden {
+		t.Error("bob isn't an admin, got", resp.Status)
+	}
+
+	conn, r := dialBrokerAs(t, l, "bob")
+	defer conn.Close()
+
+	conn.Write(BF("SUBSCRIBE", hdr{"id": "0", "destination": "test/admin-queue", "receipt": "1"}, "").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "RECEIPT" {
+		t.Error("subscribe failed", err)
+		t.FailNow()
+	}
+
+	var conns []adminConn
+	resp := adminRequest(t, srv, "GET", "/connections", "alice", "")
+	json.NewDecoder(resp.Body).Decode(&conns)
+	if len(conns) != 1 || conns[0].Principal != "bob" || conns[0].Phase != "connected" ||
+		len(conns[0].Subscriptions) != 1 || conns[0].Subscriptions[0].Destination != "test/admin-queue" {
+		t.Error("connection listing is wrong", conns)
+	}
+
+	resp = adminRequest(t, srv, "POST", "/destinations/send?name=test/admin-queue", "alice", "hi")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error("send failed", resp.Status)
+	}
+
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "MESSAGE" || string(f.Body) != "hi" {
+		t.Error("the admin message wasn't delivered", err)
+	}
+
+	var dests []adminDest
+	resp = adminRequest(t, srv, "GET", "/destinations?prefix=test/admin", "alice", "")
+	json.NewDecoder(resp.Body).Decode(&dests)
+	if len(dests) != 1 || dests[0].Type != "queue" || dests[0].Subscribers != 1 || dests[0].Enqueued != 1 {
+		t.Error("destination listing is wrong", dests)
+	}
+
+	resp = adminRequest(t, srv, "DELETE", "/connections/"+strconv.Itoa(conns[0].Id), "alice", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error("kick failed", resp.Status)
+	}
+
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "ERROR" {
+		t.Error("the kicked client should get an ERROR", err)
+	}
+
+	if resp := adminRequest(t, srv, "DELETE", "/destinations?name=test/admin-queue", "alice", ""); resp.StatusCode != http.StatusNoContent {
+		t.Error("remove failed", resp.Status)
+	}
+
+	if resp := adminRequest(t, srv, "GET", "/destinations/info?name=test/admin-queue", "alice", ""); resp.StatusCode != http.StatusNotFound {
+		t.Error("the destination should be gone", resp.Status)
+	}
+}
+
+func TestAdminLogLevels(t *testing.T) {
+	c := &Config{}
+	c.Users = map[string]UserConfig{"alice": {Passcode: "secret"}}
+	c.ACLs = []ACLRule{{Principal: "alice", Destination: "*", Permissions: []string{"admin"}}}
+
+	b, _ := startBroker(t, c)
+	defer b.Shutdown(context.Background())
+	defer logging.SetLevels(map[string]string{logging.Frame: "info"})
+
+	srv := httptest.NewServer(b.AdminHandler())
+	defer srv.Close()
+
+	if resp := adminRequest(t, srv, "POST", "/log-levels?subsystem=frame&level=loud", "alice", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Error("bad levels should be refused, got", resp.Status)
+	}
+
+	if resp := adminRequest(t, srv, "POST", "/log-levels?subsystem=frame&level=debug", "alice", ""); resp.StatusCode != http.StatusOK {
+		t.Error("setting the level failed", resp.Status)
+	}
+
+	var levels map[string]string
+	resp := adminRequest(t, srv, "GET", "/log-levels", "alice", "")
+	json.NewDecoder(resp.Body).Decode(&levels)
+	if levels["frame"] != "debug" || levels["server"] != "info" {
+		t.Error("levels are wrong", levels)
+	}
+}
+
+func TestAdminWithoutRules(t *testing.T) {
+	c := &Config{}
+	c.Users = map[string]UserConfig{"alice": {Passcode: "secret"}}
+
+	b, _ := startBroker(t, c)
+	defer b.Shutdown(context.Background())
+
+	srv := httptest.NewServer(b.AdminHandler())
+	defer srv.Close()
+
+	if resp := adminRequest(t, srv, "GET", "/connections", "alice", ""); resp.StatusCode != http.StatusForbidden {
+		t.Error("admin has to be granted, got", resp.Status)
+	}
+}
+
+func TestAdminScheduled(t *testing.T) {
+	c := &Config{}
+	c.Destinations = []DestConfig{{Name: "test/admin-scheduled", Type: "queue"}}
+	c.Users = map[string]UserConfig{"alice": {Passcode: "secret"}}
+	c.ACLs = []ACLRule{{Principal: "alice", Destination: "*", Permissions: []string{"read", "write", "admin"}}}
+
+	b, l := startBroker(t, c)
+	defer b.Shutdown(context.Background())
+
+	srv := httptest.NewServer(b.AdminHandler())
+	defer srv.Close()
+
+	conn, r := dialBrokerAs(t, l, "alice")
+	defer conn.Close()
+
+	conn.Write(BF("SEND", hdr{"destination": "test/admin-scheduled", "delay": "60000", "receipt": "1"}, "later").Bytes())
+	f, err := frame.NewFrameFromReader(r)
+	if err != nil || f.Cmd != "RECEIPT" {
+		t.Error("send failed", err)
+		t.FailNow()
+	}
+
+	msgId, ok := f.Headers.Get("message-id")
+	if !ok {
+		t.Error("the RECEIPT should say what the message id is")
+		t.FailNow()
+	}
+
+	var scheduled []dest.ScheduledInfo
+	resp := adminRequest(t, srv, "GET", "/scheduled", "alice", "")
+	json.NewDecoder(resp.Body).Decode(&scheduled)
+
+	found := false
+	for _, si := range scheduled {
+		found = found || (strconv.FormatUint(si.Id, 10) == msgId && si.Dest == "test/admin-scheduled")
+	}
+
+	if !found {
+		t.Error("the scheduled message should be listed", scheduled)
+	}
+
+	if resp := adminRequest(t, srv, "DELETE", "/scheduled/"+msgId, "alice", ""); resp.StatusCode != http.StatusNoContent {
+		t.Error("cancelling failed", resp.Status)
+	}
+}
@@ -0,0 +1,351 @@
+package broker
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"goodyear/dest"
+	"goodyear/frame"
+	"goodyear/logging"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBrokerClosed is returned by Serve once the broker has been shut
+// down.
+var ErrBrokerClosed = errors.New("broker closed")
+
+var (
+	serverLog = logging.Logger(logging.Server)
+	frameLog  = logging.Logger(logging.Frame)
+)
+
+// Connection ids are unique across every broker in the process, since
+// temporary destinations are owned by connection id.
+var connSerial int64
+
+// Broker speaks STOMP to whoever connects on the listeners it's given.
+//
+// Only one broker per process is supported at a time.  Destinations,
+// the global memory quota, scheduled messages and log levels all live
+// in the process rather than the broker, so two brokers running at
+// once would share them, and dest.Shutdown would stop both.  The
+// destinations a broker creates from its config are removed when it
+// shuts down, so another can be started after it.
+type Broker struct {
+	// Destinations and access control to start with.  Nil means no
+	// destinations and no access control.
+	Config *Config
+
+	// The destinations Start created.
+	created []dest.DestId
+
+	access    atomic.Value
+	auditLock sync.Mutex
+	auditLog  *log.Logger
+	auditFile *os.File
+
+	tracing atomic.Value
+
+	metrics *brokerMetrics
+
+	limitSettings atomic.Value
+	limits        *connLimits
+
+	connsLock sync.RWMutex
+	conns     *list.List
+
+	// Connections that haven't finished closing yet.
+	connsDone sync.WaitGroup
+
+	listenersLock sync.Mutex
+	listeners     map[net.Listener]struct{}
+	stopping      int32
+}
+
+func NewBroker() *Broker {
+	b := &Broker{}
+	b.auditLog = log.New(os.Stderr, "audit: ", log.LstdFlags)
+	b.metrics = newBrokerMetrics()
+	b.limits = newConnLimits()
+	b.conns = list.New()
+	b.listeners = make(map[net.Listener]struct{})
+
+	return b
+}
+
+// Start creates the configured destinations and sets up access
+// control.  It has to be called before Serve.
+func (b *Broker) Start() error {
+	c := b.Config
+	if c == nil {
+		c = &Config{}
+	}
+
+	ids, err := c.apply()
+	if err != nil {
+		return err
+	}
+
+	if err := b.Reload(c); err != nil {
+		removeDests(ids)
+		return err
+	}
+	b.created = ids
+
+	return nil
+}
+
+func (b *Broker) shuttingDown() bool {
+	return atomic.LoadInt32(&b.stopping) != 0
+}
+
+// Serve accepts connections on l until it fails or the broker is shut
+// down, in which case it returns ErrBrokerClosed.  It can be called
+// for more than one listener at a time.  If l is a *Listener, its
+// clients are held to its policy.
+func (b *Broker) Serve(l net.Listener) error {
+	name := l.Addr().String()
+	policy := &ListenerPolicy{}
+	if bl, ok := l.(*Listener); ok {
+		name = bl.Name
+		policy = &bl.Policy
+	}
+
+	b.listenersLock.Lock()
+	if b.shuttingDown() {
+		b.listenersLock.Unlock()
+		l.Close()
+		return ErrBrokerClosed
+	}
+	b.listeners[l] = struct{}{}
+	b.listenersLock.Unlock()
+
+	defer func() {
+		b.listenersLock.Lock()
+		delete(b.listeners, l)
+		b.listenersLock.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if b.shuttingDown() {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+
+		b.serveConn(conn, name, policy)
+	}
+}
+
+// remoteAddr names who's on the other end of a connection.  Clients on
+// a Unix socket usually don't have an address.
+func remoteAddr(conn net.Conn) string {
+	if a := conn.RemoteAddr(); a != nil && a.String() != "" {
+		return a.String()
+	}
+
+	return conn.LocalAddr().Network()
+}
+
+func (b *Broker) serveConn(conn net.Conn, listener string, policy *ListenerPolicy) {
+	// Shutdown waits on connsDone once stopping is set, so nothing
+	// can be added to it after that.
+	b.listenersLock.Lock()
+	if b.shuttingDown() {
+		b.listenersLock.Unlock()
+		conn.Close()
+		return
+	}
+	b.connsDone.Add(1)
+	b.listenersLock.Unlock()
+
+	remote := remoteAddr(conn)
+	ip := remoteHost(remote)
+	limits := b.getLimits()
+	if limit := b.limits.admit(limits, ip); limit != "" {
+		b.refuse(conn, remote, limit, b.connsDone.Done)
+		return
+	}
+
+	b.connsLock.Lock()
+	cs := newClientState(b, int(atomic.AddInt64(&connSerial, 1)-1))
+	cs.remote = remote
+	cs.ip = ip
+	cs.listener = listener
+	cs.policy = policy
+	if limits.frameRate > 0 {
+		cs.frameLimit = newTokenBucket(limits.frameRate, limits.frameBurst)
+	}
+	thisConn := b.conns.PushBack(cs)
+	b.connsLock.Unlock()
+	b.metrics.accepted.Inc()
+	cs.log.Info("accepted connection", "remote", cs.remote, "listener", listener)
+
+	if ts, _ := b.getTracing(); ts.tracesAddr(cs.remote) {
+		cs.trace.setEnabled(true)
+	}
+
+	// Outgoing Frames
+	go func(conn net.Conn, cs *clientState, myElement *list.Element) {
+		defer func() {
+			cs.getLog().Info("connection closed")
+			b.connsLock.Lock()
+			b.conns.Remove(myElement)
+			b.connsLock.Unlock()
+			conn.Close()
+			b.limits.release(cs.ip)
+			b.connsDone.Done()
+		}()
+
+		for f := range cs.outgoing {
+			cs.traceFrame(traceOut, f)
+			buf := f.Bytes()
+			n, err := conn.Write(buf)
+			b.metrics.framesOut.With(f.Cmd).Inc()
+			b.metrics.bytesOut.Add(uint64(n))
+			cs.getFrameLog().Debug("sent frame", "command", f.Cmd, "bytes", n)
+
+			// A failed write closes the connection, which the
+			// reader notices on its next read.
+			if err != nil {
+				cs.getLog().Warn("write failed", "err", err)
+				conn.Close()
+				cs.interrupt()
+			} else if n != len(buf) {
+				cs.getLog().Warn("short write", "wrote", n, "length", len(buf))
+				conn.Close()
+			}
+
+			// The connection has to go once we've sent a fatal
+			// ERROR.  Closing it here also wakes up the reader if
+			// the ERROR didn't come from it.
+			if cs.closesConnection(f) {
+				conn.Close()
+			}
+		}
+	}(conn, cs, thisConn)
+
+	// Incoming Frame Processing
+	go func(conn net.Conn, cs *clientState) {
+		r := bufio.NewReader(&countingReader{conn, &b.metrics.bytesIn})
+
+		getFrame := func() *frame.Frame {
+			f, err := frame.NewFrameFromReaderLimited(r, cs.policy.frameLimits())
+			if err == nil {
+				cs.traceFrame(traceIn, f)
+				return f
+			}
+			b.metrics.parseError(err)
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				cs.log.Debug("connection went away", "err", err)
+			} else {
+				cs.log.Warn("failed parsing frame", "err", err)
+			}
+			return nil
+		}
+
+		cs.HandleIncomingFrames(getFrame)
+	}(conn, cs)
+}
+
+func (b *Broker) clients() []*clientState {
+	b.connsLock.RLock()
+	defer b.connsLock.RUnlock()
+
+	var clients []*clientState
+	for e := b.conns.Front(); e != nil; e = e.Next() {
+		clients = append(clients, e.Value.(*clientState))
+	}
+
+	return clients
+}
+
+// How long disconnected clients get to receive their ERROR once
+// Shutdown is done waiting on them to drain.
+const closeGracePeriod = 2 * time.Second
+
+// Shutdown stops accepting connections, then gives clients until ctx
+// is done to receive what's been dispatched to them and ACK it.  New
+// SENDs and SUBSCRIBEs are refused in the meantime.  After that
+// everyone still around gets an ERROR and is disconnected, with
+// closeGracePeriod to receive it even if ctx is already done.  If they
+// hadn't all drained by the time ctx was done, its error is returned.
+//
+// Finally the destinations Start created are removed, with anything
+// still in them.  Scheduled messages are left to dest.Shutdown.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.listenersLock.Lock()
+	atomic.StoreInt32(&b.stopping, 1)
+	for l := range b.listeners {
+		l.Close()
+	}
+	b.listenersLock.Unlock()
+
+	// Producers waiting for room would never finish draining.
+	for _, cs := range b.clients() {
+		cs.interrupt()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	var err error
+drain:
+	for {
+		busy := 0
+		for _, cs := range b.clients() {
+			if !cs.idle() {
+				busy++
+			}
+		}
+
+		if busy == 0 {
+			break
+		}
+
+		serverLog.Info("waiting on connections to drain", "busy", busy)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break drain
+		}
+	}
+
+	for _, cs := range b.clients() {
+		cs.disconnect("server shutting down")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.connsDone.Wait()
+		close(done)
+	}()
+
+	grace := time.NewTimer(closeGracePeriod)
+	defer grace.Stop()
+
+	select {
+	case <-done:
+	case <-grace.C:
+		serverLog.Warn("gave up waiting on connections to close")
+		if err == nil {
+			err = errors.New("connections didn't close in time")
+		}
+	}
+
+	removeDests(b.created)
+	b.created = nil
+
+	return err
+}
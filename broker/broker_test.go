@@ -0,0 +1,210 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"goodyear/frame"
+	"net"
+	"testing"
+	"time"
+)
+
+// startBroker runs a broker on a random local port.
+func startBroker(t *testing.T, c *Config) (*Broker, net.Listener) {
+	b := NewBroker()
+	b.Config = c
+	if err := b.Start(); err != nil {
+		t.Error("failed to start", err)
+		t.FailNow()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error("failed to listen", err)
+		t.FailNow()
+	}
+
+	go b.Serve(l)
+
+	return b, l
+}
+
+func dialBroker(t *testing.T, l net.Listener) (net.Conn, *bufio.Reader) {
+	return dialBrokerAs(t, l, "")
+}
+
+// dialBrokerAs connects with a login, if there is one, using "secret"
+// as the passcode.
+func dialBrokerAs(t *testing.T, l net.Listener, login string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Error("failed to connect", err)
+		t.FailNow()
+	}
+
+	h := hdr{"accept-version": "1.2"}
+	if login != "" {
+		h["login"] = login
+		h["passcode"] = "secret"
+	}
+
+	r := bufio.NewReader(conn)
+	conn.Write(BF("CONNECT", h, "").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "CONNECTED" {
+		t.Error("didn't get connected", err)
+		t.FailNow()
+	}
+
+	return conn, r
+}
+
+func TestServe(t *testing.T) {
+	c := &Config{Destinations: []DestConfig{{Name: "test/broker-serve", Type: "queue"}}}
+	b, l := startBroker(t, c)
+	defer b.Shutdown(context.Background())
+
+	conn, r := dialBroker(t, l)
+	defer conn.Close()
+
+	conn.Write(BF("SUBSCRIBE", hdr{"id": "0", "destination": "test/broker-serve"}, "").Bytes())
+	conn.Write(BF("SEND", hdr{"destination": "test/broker-serve"}, "hello").Bytes())
+
+	f, err := frame.NewFrameFromReader(r)
+	if err != nil || f.Cmd != "MESSAGE" || string(f.Body) != "hello" {
+		t.Error("message didn't make it through the broker", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	b, l := startBroker(t, nil)
+
+	conn, r := dialBroker(t, l)
+	defer conn.Close()
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		done <- b.Shutdown(ctx)
+	}()
+
+	f, err := frame.NewFrameFromReader(r)
+	if err != nil || f.Cmd != "ERROR" {
+		t.Error("clients should be told about the shutdown", err)
+		t.FailNow()
+	}
+
+	if v, _ := f.Headers.Get("message"); v != "server shutting down" {
+		t.Error("unexpected shutdown message", v)
+	}
+
+	if _, err := frame.NewFrameFromReader(r); err == nil {
+		t.Error("the connection should have been closed")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("shutdown didn't finish cleanly", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("shutdown didn't finish")
+	}
+
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("we shouldn't be accepting connections any more")
+	}
+
+	if err := b.Serve(l); err != ErrBrokerClosed {
+		t.Error("serving after shutdown should fail", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	c := &Config{Destinations: []DestConfig{{Name: "test/broker-deadline", Type: "queue"}}}
+	b, l := startBroker(t, c)
+
+	conn, r := dialBroker(t, l)
+	defer conn.Close()
+
+	// Never ACKing the message keeps the client busy past the deadline.
+	conn.Write(BF("SUBSCRIBE", hdr{"id": "0", "destination": "test/broker-deadline", "ack": "client"}, "").Bytes())
+	conn.Write(BF("SEND", hdr{"destination": "test/broker-deadline"}, "hi").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "MESSAGE" {
+		t.Error("message wasn't delivered", err)
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := b.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("shutdown should have run out of time", err)
+	}
+
+	// The connection is gone by the time Shutdown returns, but the
+	// ERROR should have made it out first.
+	if len(b.clients()) != 0 {
+		t.Error("shutdown returned before the connection closed")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := frame.NewFrameFromReader(r)
+	if err != nil || f.Cmd != "ERROR" {
+		t.Error("clients still around at the deadline should be told about the shutdown", err)
+		t.FailNow()
+	}
+
+	if v, _ := f.Headers.Get("message"); v != "server shutting down" {
+		t.Error("unexpected shutdown message", v)
+	}
+}
+
+func TestShutdownPausedProducer(t *testing.T) {
+	c := &Config{Destinations: []DestConfig{{Name: "test/broker-full", Type: "queue", HighWater: 1}}}
+	b, l := startBroker(t, c)
+
+	conn, r := dialBroker(t, l)
+	defer conn.Close()
+
+	// Nobody's consuming, so the second SEND waits for room forever.
+	conn.Write(BF("SEND", hdr{"destination": "test/broker-full", "receipt": "1"}, "hi").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "RECEIPT" {
+		t.Error("the first send should have worked", err)
+		t.FailNow()
+	}
+	conn.Write(BF("SEND", hdr{"destination": "test/broker-full"}, "hi").Bytes())
+
+	// Give the producer a chance to pause.
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := b.Shutdown(ctx); err != nil {
+		t.Error("a paused producer shouldn't hold up shutdown", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	b, l := startBroker(t, DefaultConfig())
+
+	conn, _ := dialBroker(t, l)
+	defer conn.Close()
+
+	first := b.clients()[0].id
+	b.Shutdown(context.Background())
+
+	// A second broker in the same process can create the same
+	// destinations, and doesn't reuse the first one's connection ids.
+	b, l = startBroker(t, DefaultConfig())
+	defer b.Shutdown(context.Background())
+
+	other, _ := dialBroker(t, l)
+	defer other.Close()
+
+	if cs := b.clients(); len(cs) != 1 || cs[0].id <= first {
+		t.Error("connection ids should carry on from the first broker")
+	}
+}
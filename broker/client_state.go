@@ -0,0 +1,834 @@
+package broker
+
+import (
+	"container/list"
+	"fmt"
+	"goodyear/dest"
+	"goodyear/frame"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type clientStatePhase int
+
+const (
+	opened clientStatePhase = iota
+	connected
+	disconnected
+	errorPhase
+)
+
+type clientState struct {
+	broker   *Broker
+	phase    int32
+	id       int
+	remote   string
+	ip       string
+	listener string
+	policy   *ListenerPolicy
+	version  string
+	outgoing chan *frame.Frame
+	ackId    int
+
+	// Only the frame handling loop changes these, and it takes the
+	// lock to do so.  Anything else has to hold it to look at them.
+	infoLock  sync.Mutex
+	principal string
+	subs      map[string]*clientSub
+	log       *slog.Logger
+	frameLog  *slog.Logger
+
+	// The frame being handled, and whether handling it failed.
+	cur    *frame.Frame
+	failed bool
+
+	// The id a SEND gave its message, for the RECEIPT.
+	sentId string
+
+	// How fast the client may send frames, if there's a limit.
+	frameLimit *tokenBucket
+
+	// Frames sent and received, if the connection is being traced.
+	trace connTrace
+
+	// The last fatal ERROR handed to the writer.  The connection is
+	// closed once it has been written.
+	fatal atomic.Value
+
+	// Messages handed to us by destinations, waiting to be turned
+	// into MESSAGE frames.  Subscriptions never have more of these
+	// than their prefetch allows, so this never blocks a destination.
+	pendingLock      sync.Mutex
+	pending          []*clientSubMessage
+	pendingReady     chan struct{}
+	disconnectReason string
+	done             chan struct{}
+
+	// Closed when the frame handling loop should stop waiting on
+	// anything, because the client is going away or the broker is
+	// shutting down.
+	interrupted   chan struct{}
+	interruptOnce sync.Once
+
+	// Delivered messages waiting on an ACK or NACK, oldest first.
+	ackLock sync.Mutex
+	unacked *list.List
+}
+
+var phaseNames = map[clientStatePhase]string{
+	opened:       "opened",
+	connected:    "connected",
+	disconnected: "disconnected",
+	errorPhase:   "error",
+}
+
+func (p clientStatePhase) String() string {
+	return phaseNames[p]
+}
+
+func (cs *clientState) getPhase() clientStatePhase {
+	return clientStatePhase(atomic.LoadInt32(&cs.phase))
+}
+
+func (cs *clientState) setPhase(p clientStatePhase) {
+	atomic.StoreInt32(&cs.phase, int32(p))
+}
+
+// getLog returns the connection's logger, for use outside the frame
+// handling loop.
+func (cs *clientState) getLog() *slog.Logger {
+	cs.infoLock.Lock()
+	defer cs.infoLock.Unlock()
+
+	return cs.log
+}
+
+func (cs *clientState) getFrameLog() *slog.Logger {
+	cs.infoLock.Lock()
+	defer cs.infoLock.Unlock()
+
+	return cs.frameLog
+}
+
+type clientAck struct {
+	id  string
+	sub *clientSub
+	msg *dest.Message
+}
+
+func (cs *clientState) queueMessage(subMsg *clientSubMessage) {
+	cs.pendingLock.Lock()
+	cs.pending = append(cs.pending, subMsg)
+	cs.pendingLock.Unlock()
+
+	select {
+	case cs.pendingReady <- struct{}{}:
+	default:
+	}
+}
+
+// disconnect throws the client off from outside the frame handling
+// loop, e.g. when a destination decides it can't keep up.
+func (cs *clientState) disconnect(reason string) {
+	cs.pendingLock.Lock()
+	if cs.disconnectReason == "" {
+		cs.disconnectReason = reason
+	}
+	cs.pendingLock.Unlock()
+	cs.interrupt()
+
+	select {
+	case cs.pendingReady <- struct{}{}:
+	default:
+	}
+}
+
+func (cs *clientState) interrupt() {
+	cs.interruptOnce.Do(func() {
+		close(cs.interrupted)
+	})
+}
+
+func (cs *clientState) takePending() ([]*clientSubMessage, string) {
+	cs.pendingLock.Lock()
+	defer cs.pendingLock.Unlock()
+
+	msgs := cs.pending
+	cs.pending = nil
+
+	return msgs, cs.disconnectReason
+}
+
+// idle says whether everything dispatched to this client has been
+// delivered and acknowledged.
+func (cs *clientState) idle() bool {
+	cs.pendingLock.Lock()
+	pending := len(cs.pending)
+	cs.pendingLock.Unlock()
+
+	cs.ackLock.Lock()
+	unacked := cs.unacked.Len()
+	cs.ackLock.Unlock()
+
+	return pending == 0 && unacked == 0
+}
+
+func (cs *clientState) deliver(subMsg *clientSubMessage) {
+	sub := subMsg.sub
+	msg := subMsg.msg
+
+	f := frame.NewFrame()
+	f.Cmd = "MESSAGE"
+	f.Headers.Add("message-id", strconv.FormatUint(msg.Id, 10))
+	f.Headers.Add("subscription", sub.id)
+
+	// A message that was on its way when the subscription went goes
+	// back where it came from.
+	cs.ackLock.Lock()
+	if sub.closed {
+		cs.ackLock.Unlock()
+		dest.Requeue(sub.dest, msg)
+		return
+	}
+
+	if sub.ackMode != ackModeAuto {
+		ack := strconv.FormatUint(uint64(cs.ackId), 10)
+		cs.ackId++
+
+		f.Headers.Add("ack", ack)
+		cs.unacked.PushBack(&clientAck{ack, sub, msg})
+	}
+	cs.ackLock.Unlock()
+
+	if msg.Retained {
+		f.Headers.Add("retained", "true")
+	}
+
+	for k, values := range msg.Frame.Headers {
+		for _, v := range values {
+			f.Headers.Add(k, v)
+		}
+	}
+
+	f.Body = msg.Frame.Body
+
+	cs.outgoing <- f
+
+	if sub.ackMode == ackModeAuto {
+		dest.Ack(msg)
+		sub.release(1)
+	}
+}
+
+func (cs *clientState) handleCmdAck(f *frame.Frame, ack bool) {
+	id, ok := f.Headers.Get("id")
+	if !ok {
+		cs.ErrorString(fmt.Sprintf("an id is required to %s.", f.Cmd))
+		return
+	}
+
+	cs.ackLock.Lock()
+
+	var found *clientAck
+	for e := cs.unacked.Front(); e != nil; e = e.Next() {
+		if a := e.Value.(*clientAck); a.id == id {
+			found = a
+			break
+		}
+	}
+
+	if found == nil {
+		cs.ackLock.Unlock()
+		cs.RejectFrame(fmt.Sprintf("ack id '%s' doesn't exist.", id))
+		return
+	}
+
+	// In client mode an ACK covers everything delivered to the
+	// subscription up to and including the named message.
+	var done []*clientAck
+	for e := cs.unacked.Front(); e != nil; {
+		a := e.Value.(*clientAck)
+		next := e.Next()
+
+		if a == found || (a.sub == found.sub && found.sub.ackMode == ackModeClient) {
+			done = append(done, a)
+			cs.unacked.Remove(e)
+		}
+
+		if a == found {
+			break
+		}
+
+		e = next
+	}
+
+	cs.ackLock.Unlock()
+
+	// XXX - A message every subscriber NACKs goes round forever;
+	// it ought to end up in a dead letter queue.
+	for _, a := range done {
+		if ack {
+			dest.Ack(a.msg)
+		} else {
+			dest.Nack(a.msg)
+			dest.Requeue(a.sub.dest, a.msg)
+		}
+	}
+
+	found.sub.release(len(done))
+}
+
+// closeSub stops delivering to a subscription that's gone, and puts
+// back what it was given but didn't acknowledge.  It has to be
+// unsubscribed from its destination first.
+func (cs *clientState) closeSub(sub *clientSub) {
+	var msgs []*dest.Message
+
+	cs.ackLock.Lock()
+	sub.closed = true
+	for e := cs.unacked.Front(); e != nil; {
+		next := e.Next()
+		if a := e.Value.(*clientAck); a.sub == sub {
+			msgs = append(msgs, a.msg)
+			cs.unacked.Remove(e)
+		}
+		e = next
+	}
+	cs.ackLock.Unlock()
+
+	for _, m := range msgs {
+		dest.Requeue(sub.dest, m)
+	}
+}
+
+// Headers whose values are kept out of ERRORs and traces.
+var secretHeaders = map[string]bool{"passcode": true}
+
+// redactHeaders copies headers, blanking out the secret ones.
+func redactHeaders(h frame.FrameHeader) frame.FrameHeader {
+	r := make(frame.FrameHeader, len(h))
+	for k, v := range h {
+		if secretHeaders[k] {
+			r[k] = []string{"<redacted>"}
+		} else {
+			r[k] = append([]string{}, v...)
+		}
+	}
+
+	return r
+}
+
+// errorFrame builds an ERROR.  The message header carries a short
+// summary, and the body repeats it along with the offending frame, if
+// there was one, less any secrets.
+func errorFrame(cause *frame.Frame, msg string) *frame.Frame {
+	f := frame.NewFrame()
+
+	f.Cmd = "ERROR"
+	f.Headers.Add("message", msg)
+
+	body := msg + "\r\n"
+	if cause != nil {
+		if v, ok := cause.Headers.Get("receipt"); ok {
+			f.Headers.Add("receipt-id", v)
+		}
+
+		echo := &frame.Frame{Cmd: cause.Cmd, Headers: redactHeaders(cause.Headers), Body: cause.Body}
+		b := echo.Bytes()
+		body += "\r\nThe message:\r\n-----\r\n" + string(b[:len(b)-1]) + "\r\n-----\r\n"
+	}
+	f.Body = []byte(body)
+
+	f.Headers.Add("content-type", "text/plain")
+	f.Headers.Add("content-length", strconv.FormatUint(uint64(len(f.Body)), 10))
+
+	return f
+}
+
+// Error sends an ERROR about the frame being handled.  Fatal errors
+// end the connection; anything else only fails the frame, which then
+// gets no RECEIPT.
+func (cs *clientState) Error(msg string, fatal bool) error {
+	f := errorFrame(cs.cur, msg)
+
+	if fatal {
+		cs.fatal.Store(f)
+		cs.outgoing <- f
+		cs.setPhase(errorPhase)
+	} else {
+		cs.outgoing <- f
+		cs.failed = true
+	}
+
+	return nil
+}
+
+// ErrorString reports a fatal error, after which the connection is
+// closed.
+func (cs *clientState) ErrorString(msg string) error {
+	return cs.Error(msg, true)
+}
+
+// RejectFrame reports a recoverable error.  The frame isn't acted on,
+// but the connection stays up.
+func (cs *clientState) RejectFrame(msg string) error {
+	return cs.Error(msg, false)
+}
+
+// closesConnection says whether writing f should be the last thing
+// done on the connection.
+func (cs *clientState) closesConnection(f *frame.Frame) bool {
+	last, _ := cs.fatal.Load().(*frame.Frame)
+	return f == last
+}
+
+func (cs *clientState) handleCmdSubscribe(f *frame.Frame) {
+	if cs.broker.shuttingDown() {
+		cs.RejectFrame("server is shutting down")
+		return
+	}
+
+	s := &clientSub{}
+	s.client = cs
+
+	if id, ok := f.Headers.Get("id"); ok && len(id) > 0 {
+		s.id = id
+	} else {
+		cs.ErrorString("id header required on SUBSCRIBE")
+		return
+	}
+
+	if ack, ok := f.Headers.Get("ack"); ok {
+		switch ack {
+		case "auto":
+			s.ackMode = ackModeAuto
+		case "client":
+			s.ackMode = ackModeClient
+		case "client-individual":
+			s.ackMode = ackModeClientIndividual
+		default:
+			cs.RejectFrame(fmt.Sprintf("ack mode '%s' invalid on SUBSCRIBE", ack))
+			return
+		}
+	} else {
+		s.ackMode = ackModeAuto
+	}
+
+	if dst, ok := f.Headers.Get("destination"); ok && len(dst) > 1 {
+		if !cs.policy.allows(dst) {
+			cs.RejectFrame(fmt.Sprintf("'%s' isn't available on this listener", dst))
+			return
+		}
+
+		if err := cs.broker.authorize(cs.id, cs.principal, permRead, dst); err != nil {
+			cs.RejectFrame(fmt.Sprintf("failed to subscribe '%s'", err))
+			return
+		}
+
+		id, err := cs.resolveDest(dst)
+		if err != nil {
+			cs.RejectFrame(fmt.Sprintf("failed to subscribe '%s'", err))
+			return
+		}
+
+		s.dest = id
+	} else {
+		cs.ErrorString("a destination headers is required for SUBSCRIBE")
+		return
+	}
+
+	s.prefetch = defaultPrefetch
+	for _, h := range []string{"prefetch-size", "activemq.prefetchSize"} {
+		if v, ok := f.Headers.Get(h); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				cs.RejectFrame(fmt.Sprintf("%s '%s' invalid on SUBSCRIBE", h, v))
+				return
+			}
+
+			s.prefetch = n
+			break
+		}
+	}
+
+	if _, exists := cs.subs[s.id]; exists {
+		cs.RejectFrame(fmt.Sprintf("a subscription IDed '%s' already exists.", s.id))
+		return
+	}
+
+	var from dest.ReplayPoint
+	replay := false
+
+	if v, ok := f.Headers.Get("from-message-id"); ok {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			cs.RejectFrame(fmt.Sprintf("from-message-id '%s' invalid on SUBSCRIBE", v))
+			return
+		}
+
+		from.MessageId = id
+		from.HasMessageId = true
+		replay = true
+	} else if v, ok := f.Headers.Get("from-time"); ok {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			cs.RejectFrame(fmt.Sprintf("from-time '%s' invalid on SUBSCRIBE", v))
+			return
+		}
+
+		from.Time = time.Unix(0, ms*int64(time.Millisecond))
+		replay = true
+	}
+
+	var err error
+	if replay {
+		err = dest.SubscribeFrom(s.dest, s, from)
+	} else {
+		err = dest.Subscribe(s.dest, s)
+	}
+
+	if err != nil {
+		cs.RejectFrame(fmt.Sprintf("failed to subscribe '%s'", err))
+		return
+	}
+
+	cs.infoLock.Lock()
+	cs.subs[s.id] = s
+	cs.infoLock.Unlock()
+}
+
+// resolveDest maps a destination name used by this connection onto
+// the destination it refers to.  Temporary queues are private to the
+// connection, so they get a globally unique name.
+func (cs *clientState) resolveDest(dst string) (dest.DestId, error) {
+	if dest.IsTempQueue(dst) {
+		return dest.TempQueue(cs.id, dst)
+	}
+
+	return dest.DestId(dst), nil
+}
+
+func (cs *clientState) handleCmdSend(f *frame.Frame) {
+	dst, ok := f.Headers.Get("destination")
+	if !ok {
+		cs.ErrorString("SEND requires a destination.")
+		return
+	}
+
+	if cs.broker.shuttingDown() {
+		cs.RejectFrame("server is shutting down")
+		return
+	}
+
+	if !cs.policy.allows(dst) {
+		cs.RejectFrame(fmt.Sprintf("'%s' isn't available on this listener", dst))
+		return
+	}
+
+	if err := cs.broker.authorize(cs.id, cs.principal, permWrite, dst); err != nil {
+		cs.RejectFrame(fmt.Sprintf("failed to send '%s'", err))
+		return
+	}
+
+	id, err := cs.resolveDest(dst)
+	if err != nil {
+		cs.RejectFrame(fmt.Sprintf("failed to send '%s'", err))
+		return
+	}
+
+	if replyTo, ok := f.Headers.Get("reply-to"); ok && dest.IsTempQueue(replyTo) {
+		replyId, err := cs.resolveDest(replyTo)
+		if err != nil {
+			cs.RejectFrame(fmt.Sprintf("failed to send '%s'", err))
+			return
+		}
+
+		f.Headers["reply-to"][0] = string(replyId)
+	}
+
+	// Stop reading from a producer that's outrunning its consumers.
+	// If it wants a receipt, tell it to back off instead.
+	if dest.Blocked(id) {
+		if _, ok := f.Headers.Get("receipt"); ok {
+			cs.RejectFrame(fmt.Sprintf("destination '%s' is full, try again later", dst))
+			return
+		}
+
+		// XXX - A client that just goes away isn't noticed until
+		// there's room, since nothing's reading from it meanwhile.
+		cs.log.Info("paused, destination is full", "destination", id)
+		if !dest.WaitForRoom(id, cs.interrupted) {
+			cs.RejectFrame(fmt.Sprintf("destination '%s' is full, gave up waiting", dst))
+			return
+		}
+	}
+
+	cs.log.Debug("sending to destination", "destination", id)
+	msgId, err := dest.SendId(id, f)
+	if err != nil {
+		cs.RejectFrame(fmt.Sprintf("failed to send '%s'", err))
+		return
+	}
+
+	cs.sentId = strconv.FormatUint(msgId, 10)
+}
+
+func (cs *clientState) handleCmdUnsubscribe(curFrame *frame.Frame) {
+	if id, ok := curFrame.Headers.Get("id"); ok {
+		if sub, exists := cs.subs[id]; exists {
+			dest.Unsubscribe(sub.dest, sub)
+			cs.closeSub(sub)
+			cs.infoLock.Lock()
+			delete(cs.subs, id)
+			cs.infoLock.Unlock()
+		} else {
+			cs.RejectFrame(fmt.Sprintf("subscription id '%s' doesn't exist.", id))
+		}
+	} else {
+		cs.ErrorString("an id is required to UNSUBSCRIBE.")
+	}
+}
+
+type frameProvider func() *frame.Frame
+
+func (cs *clientState) HandleIncomingFrames(getFrame frameProvider) {
+	forwarderDone := make(chan struct{})
+
+	defer func() {
+		for _, sub := range cs.subs {
+			dest.Unsubscribe(sub.dest, sub)
+			cs.closeSub(sub)
+		}
+
+		// Clean up everything.
+		close(cs.done)
+		<-forwarderDone
+		close(cs.outgoing)
+
+		// Anything that never got as far as the client goes back too.
+		msgs, _ := cs.takePending()
+		for _, subMsg := range msgs {
+			dest.Requeue(subMsg.sub.dest, subMsg.msg)
+		}
+		dest.RemoveOwned(cs.id)
+	}()
+
+	go func() {
+		defer close(forwarderDone)
+
+		for {
+			select {
+			case <-cs.pendingReady:
+			case <-cs.done:
+				return
+			}
+
+			msgs, reason := cs.takePending()
+			if reason != "" {
+				cs.getLog().Warn("disconnected", "reason", reason)
+				f := errorFrame(nil, reason)
+				cs.fatal.Store(f)
+				cs.outgoing <- f
+				<-cs.done
+				return
+			}
+
+			for _, subMsg := range msgs {
+				cs.deliver(subMsg)
+			}
+		}
+	}()
+
+	var curFrame *frame.Frame
+	processFrame := func() {
+		curFrame = getFrame()
+		cs.cur = curFrame
+		cs.failed = false
+		cs.sentId = ""
+		if curFrame != nil {
+			cs.broker.metrics.framesIn.With(commandLabel(curFrame.Cmd)).Inc()
+			cs.frameLog.Debug("received frame", "command", curFrame.Cmd)
+
+			if cs.frameLimit == nil || cs.frameLimit.allow(time.Now()) {
+				return
+			}
+
+			cs.broker.metrics.limited.With(limitFrameRate).Inc()
+			cs.log.Warn("sending frames too fast")
+			curFrame = nil
+			cs.ErrorString("too many frames, slow down.  good bye!")
+			return
+		}
+
+		curFrame = nil
+		cs.ErrorString("failed to parse frame.  good bye!")
+		return
+	}
+
+	handleReceipt := func() {
+		if cs.failed {
+			return
+		}
+
+		if v, ok := curFrame.Headers.Get("receipt"); ok {
+			resp := frame.NewFrame()
+			resp.Cmd = "RECEIPT"
+			resp.Headers.Add("receipt-id", v)
+			if cs.sentId != "" {
+				resp.Headers.Add("message-id", cs.sentId)
+			}
+			cs.outgoing <- resp
+		}
+	}
+
+	// Before connection.
+	for cs.getPhase() == opened {
+		processFrame()
+		if curFrame == nil {
+			return
+		}
+
+		if err := curFrame.ValidateFrame(); err != nil {
+			cs.broker.metrics.parseErrors.With("invalid").Inc()
+			cs.ErrorString(err.Error())
+			break
+		}
+
+		switch curFrame.Cmd {
+		case "CONNECT", "STOMP":
+			if _, ok := curFrame.Headers.Get("receipt"); ok {
+				cs.ErrorString("receipt not allowed during connect.")
+				break
+			}
+
+			supVersion, ok := curFrame.Headers.Get("accept-version")
+
+			if !ok {
+				cs.ErrorString("an accept-version header is required")
+				break
+			}
+
+			validVersion := false
+
+			for _, v := range strings.Split(supVersion, ",") {
+				if v == "1.2" {
+					validVersion = true
+				}
+			}
+
+			if !validVersion {
+				cs.ErrorString("this server only supports standard version 1.2")
+				break
+			}
+
+			if !cs.broker.limits.allowConnect(cs.broker.getLimits(), cs.ip) {
+				cs.broker.metrics.limited.With(limitConnectRate).Inc()
+				cs.log.Warn("connecting too often")
+				cs.ErrorString("too many connection attempts, slow down.")
+				break
+			}
+
+			login, _ := curFrame.Headers.Get("login")
+			passcode, _ := curFrame.Headers.Get("passcode")
+			ac := cs.broker.getAccessControl()
+			if cs.policy.RequireLogin && (login == "" || len(ac.users) == 0) {
+				cs.broker.auditLog.Printf("login required conn=%d listener=%s", cs.id, cs.listener)
+				cs.ErrorString("this listener requires a login.")
+				break
+			}
+
+			principal, ok := ac.authenticate(login, passcode)
+			if !ok {
+				cs.broker.auditLog.Printf("login failed conn=%d principal=%s", cs.id, login)
+				cs.ErrorString("login failed.")
+				break
+			}
+			if principal != "" {
+				cs.infoLock.Lock()
+				cs.principal = principal
+				cs.log = cs.log.With("principal", principal)
+				cs.frameLog = cs.frameLog.With("principal", principal)
+				cs.infoLock.Unlock()
+			}
+
+			cs.version = "1.2"
+			cs.setPhase(connected)
+			resp := frame.NewFrame()
+			resp.Cmd = "CONNECTED"
+			resp.Headers.Add("version", cs.version)
+			if _, ok := curFrame.Headers.Get("heart-beat"); ok {
+				resp.Headers.Add("heart-beat", "0,0")
+			}
+
+			cs.outgoing <- resp
+		default:
+			cs.ErrorString("unknown/unallowed command.")
+		}
+	}
+
+	// Now we're connected.
+	for cs.getPhase() == connected {
+		processFrame()
+		if curFrame == nil {
+			return
+		}
+
+		if err := curFrame.ValidateFrame(); err != nil {
+			cs.broker.metrics.parseErrors.With("invalid").Inc()
+			cs.ErrorString(err.Error())
+			break
+		}
+
+		switch curFrame.Cmd {
+		case "CONNECT":
+			cs.ErrorString("you're already connected.")
+
+		case "DISCONNECT":
+			cs.log.Info("requested disconnect")
+			cs.setPhase(disconnected)
+
+		case "SUBSCRIBE":
+			cs.handleCmdSubscribe(curFrame)
+
+		case "UNSUBSCRIBE":
+			cs.handleCmdUnsubscribe(curFrame)
+
+		case "ACK":
+			cs.handleCmdAck(curFrame, true)
+
+		case "NACK":
+			cs.handleCmdAck(curFrame, false)
+
+		case "SEND":
+			cs.handleCmdSend(curFrame)
+		default:
+			cs.ErrorString("unknown command.")
+		}
+
+		handleReceipt()
+	}
+}
+
+func newClientState(b *Broker, connId int) *clientState {
+	cs := &clientState{}
+	cs.broker = b
+	cs.setPhase(opened)
+	cs.id = connId
+	cs.ackId = 0
+	cs.version = ""
+	cs.outgoing = make(chan *frame.Frame, 0)
+	cs.subs = make(map[string]*clientSub)
+	cs.pendingReady = make(chan struct{}, 1)
+	cs.done = make(chan struct{})
+	cs.interrupted = make(chan struct{})
+	cs.unacked = list.New()
+	cs.policy = &ListenerPolicy{}
+	cs.log = serverLog.With("conn", connId)
+	cs.frameLog = frameLog.With("conn", connId)
+
+	return cs
+}
@@ -0,0 +1,266 @@
+package broker
+
+import (
+	"goodyear/dest"
+	"goodyear/frame"
+	"strings"
+	"testing"
+)
+
+type hdr map[string]string
+
+func BF(cmd string, headers hdr, body string) *frame.Frame {
+	f := frame.NewFrame()
+	f.Cmd = cmd
+
+	for k, v := range headers {
+		f.Headers.Add(k, v)
+	}
+
+	f.Body = []byte(body)
+	f.Complete = true
+
+	return f
+}
+
+type simpleSeq struct {
+	t        *testing.T
+	incoming chan *frame.Frame
+	cs       *clientState
+}
+
+func (f *simpleSeq) Finish() {
+	close(f.incoming)
+	if _, ok := <-f.cs.outgoing; ok {
+		f.t.Error("we have additional responses when we shouldn't")
+	}
+}
+
+func (f *simpleSeq) Send(cmd string, headers hdr, body string) {
+	req := BF(cmd, headers, body)
+
+	f.incoming <- req
+}
+
+func (f *simpleSeq) Expect(cmd string) *frame.Frame {
+	resp := <-f.cs.outgoing
+	if resp.Cmd != cmd {
+		f.t.Errorf("command didn't match")
+	}
+
+	return resp
+}
+
+func (f *simpleSeq) ExpectHeaders(cmd string, headers hdr) {
+	resp := <-f.cs.outgoing
+	if resp.Cmd != cmd {
+		f.t.Errorf("command didn't match")
+	}
+
+	for k, v := range headers {
+		if h, ok := resp.Headers.Get(k); !ok || h != v {
+			f.t.Errorf("header didn't match %s: %s != %s", k, v, h)
+		}
+	}
+}
+
+func newSimpleSeq(t *testing.T) *simpleSeq {
+	f := &simpleSeq{}
+	f.incoming = make(chan *frame.Frame, 0)
+	f.t = t
+	f.cs = newClientState(NewBroker(), 0)
+
+	go func() {
+		getFrame := func() *frame.Frame {
+			req := <-f.incoming
+			return req
+		}
+
+		f.cs.HandleIncomingFrames(getFrame)
+	}()
+
+	return f
+}
+
+func TestBadVersion1(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.1"}, "")
+	s.Expect("ERROR")
+	s.Finish()
+}
+
+func TestBadVersion2(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.1,1.3,blarg"}, "")
+	s.Expect("ERROR")
+	s.Finish()
+}
+
+func TestConnection1(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("DISCONNECT", hdr{"receipt": "yoh"}, "")
+	s.ExpectHeaders("RECEIPT", hdr{"receipt-id": "yoh"})
+	s.Finish()
+}
+
+func TestConnection2(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("DISCONNECT", hdr{"receipt": "yoh"}, "")
+	s.ExpectHeaders("RECEIPT", hdr{"receipt-id": "yoh"})
+	s.Finish()
+}
+
+func TestSendFailure1(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("SEND", hdr{}, "")
+	s.Expect("ERROR")
+	s.Finish()
+}
+
+func TestSend1(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("SEND", hdr{"destination": "queue/someplace"}, "")
+	s.Send("DISCONNECT", hdr{}, "")
+	s.Finish()
+}
+
+func TestTempQueue1(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("SUBSCRIBE", hdr{"id": "0", "destination": "/temp-queue/replies"}, "")
+	s.Send("SEND", hdr{"destination": "/temp-queue/replies", "reply-to": "/temp-queue/replies"}, "hi")
+	s.ExpectHeaders("MESSAGE", hdr{"subscription": "0"})
+	s.Send("DISCONNECT", hdr{}, "")
+	s.Finish()
+}
+
+func TestPrefetch1(t *testing.T) {
+	dest.AddDest("test/prefetch", dest.NewQueue())
+	defer dest.RemoveDest("test/prefetch")
+
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("SUBSCRIBE", hdr{"id": "0", "destination": "test/prefetch", "ack": "client", "prefetch-size": "2"}, "")
+	s.Send("SEND", hdr{"destination": "test/prefetch"}, "one")
+	s.Send("SEND", hdr{"destination": "test/prefetch"}, "two")
+	s.Send("SEND", hdr{"destination": "test/prefetch"}, "three")
+	s.Expect("MESSAGE")
+	m := s.Expect("MESSAGE")
+
+	ack, _ := m.Headers.Get("ack")
+	s.Send("ACK", hdr{"id": ack}, "")
+	m = s.Expect("MESSAGE")
+	if string(m.Body) != "three" {
+		t.Error("the held message wasn't delivered after the ACK")
+	}
+
+	s.Send("DISCONNECT", hdr{}, "")
+	s.Finish()
+}
+
+func TestUnsubscribeRequeues1(t *testing.T) {
+	dest.AddDest("test/unsubscribe-requeue", dest.NewQueue())
+	defer dest.RemoveDest("test/unsubscribe-requeue")
+
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("SUBSCRIBE", hdr{"id": "0", "destination": "test/unsubscribe-requeue", "ack": "client-individual"}, "")
+	s.Send("SEND", hdr{"destination": "test/unsubscribe-requeue"}, "one")
+	s.ExpectHeaders("MESSAGE", hdr{"subscription": "0"})
+	s.Send("UNSUBSCRIBE", hdr{"id": "0"}, "")
+	s.Send("SUBSCRIBE", hdr{"id": "1", "destination": "test/unsubscribe-requeue"}, "")
+	m := s.Expect("MESSAGE")
+	if v, _ := m.Headers.Get("subscription"); v != "1" || string(m.Body) != "one" {
+		t.Error("the message should have been put back for the next subscriber")
+	}
+
+	if !s.cs.idle() {
+		t.Error("the unacknowledged message should have been forgotten")
+	}
+
+	s.Send("DISCONNECT", hdr{}, "")
+	s.Finish()
+}
+
+func TestNackRedelivers1(t *testing.T) {
+	dest.AddDest("test/nack-redeliver", dest.NewQueue())
+	defer dest.RemoveDest("test/nack-redeliver")
+
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("SUBSCRIBE", hdr{"id": "0", "destination": "test/nack-redeliver", "ack": "client-individual"}, "")
+	s.Send("SEND", hdr{"destination": "test/nack-redeliver"}, "one")
+	m := s.Expect("MESSAGE")
+
+	ack, _ := m.Headers.Get("ack")
+	s.Send("NACK", hdr{"id": ack}, "")
+	m = s.Expect("MESSAGE")
+	if string(m.Body) != "one" {
+		t.Error("the NACKed message should have been redelivered")
+	}
+
+	ack, _ = m.Headers.Get("ack")
+	s.Send("ACK", hdr{"id": ack}, "")
+	s.Send("DISCONNECT", hdr{}, "")
+	s.Finish()
+}
+
+func TestAckFailure1(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("ACK", hdr{"id": "12"}, "")
+	s.Expect("ERROR")
+	s.Send("DISCONNECT", hdr{}, "")
+	s.Finish()
+}
+
+func TestErrorReceipt1(t *testing.T) {
+	s := newSimpleSeq(t)
+
+	s.Send("CONNECT", hdr{"accept-version": "1.2"}, "")
+	s.Expect("CONNECTED")
+	s.Send("UNSUBSCRIBE", hdr{"id": "nope", "receipt": "77"}, "")
+	f := s.Expect("ERROR")
+
+	if v, ok := f.Headers.Get("receipt-id"); !ok || v != "77" {
+		t.Error("ERROR didn't carry the receipt-id")
+	}
+
+	if v, ok := f.Headers.Get("message"); !ok || v != "subscription id 'nope' doesn't exist." {
+		t.Error("ERROR didn't carry a message header")
+	}
+
+	if !strings.Contains(string(f.Body), "UNSUBSCRIBE\r\n") {
+		t.Error("ERROR body didn't include the offending frame")
+	}
+
+	// The connection is still usable, and the failed frame got no
+	// RECEIPT.
+	s.Send("DISCONNECT", hdr{"receipt": "78"}, "")
+	s.ExpectHeaders("RECEIPT", hdr{"receipt-id": "78"})
+	s.Finish()
+}
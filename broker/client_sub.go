@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"fmt"
+	"goodyear/dest"
+	"sync"
+)
+
+type clientSubAckMode int
+
+const (
+	ackModeAuto clientSubAckMode = iota
+	ackModeClient
+	ackModeClientIndividual
+)
+
+var ackModeNames = map[clientSubAckMode]string{
+	ackModeAuto:             "auto",
+	ackModeClient:           "client",
+	ackModeClientIndividual: "client-individual",
+}
+
+func (m clientSubAckMode) String() string {
+	return ackModeNames[m]
+}
+
+// How many unacknowledged messages a subscription will take when the
+// SUBSCRIBE didn't say.
+const defaultPrefetch = 1000
+
+type clientSub struct {
+	client   *clientState
+	id       string
+	dest     dest.DestId
+	ackMode  clientSubAckMode
+	prefetch int
+
+	lock    sync.Mutex
+	unacked int
+
+	// Set once the subscription is gone, under the client's ackLock.
+	closed bool
+}
+
+type clientSubMessage struct {
+	sub *clientSub
+	msg *dest.Message
+}
+
+func (sub *clientSub) Send(m *dest.Message) error {
+	sub.lock.Lock()
+	sub.unacked++
+	sub.lock.Unlock()
+
+	sub.client.queueMessage(&clientSubMessage{sub, m})
+
+	return nil
+}
+
+func (sub *clientSub) outstanding() int {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	return sub.unacked
+}
+
+func (sub *clientSub) HasCredit() bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	return sub.unacked < sub.prefetch
+}
+
+// release gives back credit for messages that have been acknowledged,
+// and lets the destination know we can take more.
+func (sub *clientSub) release(n int) {
+	if n == 0 {
+		return
+	}
+
+	sub.lock.Lock()
+	sub.unacked -= n
+	sub.lock.Unlock()
+
+	dest.Dispatch(sub.dest)
+}
+
+func (sub *clientSub) Disconnect(reason string) {
+	sub.client.disconnect(reason)
+}
+
+func (sub *clientSub) String() string {
+	return fmt.Sprintf("conn %d sub %s", sub.client.id, sub.id)
+}
+
+func (sub *clientSub) OwnerId() int {
+	return sub.client.id
+}
@@ -0,0 +1,292 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"goodyear/dest"
+	"os"
+	"time"
+)
+
+// Config describes the destinations and access control a broker
+// starts with.  The goodyear server reads it from the JSON file named
+// by -config.
+type Config struct {
+	// Broker-wide memory limits, in bytes.
+	HighWater   int64 `json:"high-water"`
+	LowWater    int64 `json:"low-water"`
+	MemoryLimit int64 `json:"memory-limit"`
+
+	Destinations []DestConfig `json:"destinations"`
+
+	// Access control, which Broker.Reload can swap out.
+	Users    map[string]UserConfig `json:"users"`
+	ACLs     []ACLRule             `json:"acls"`
+	AuditLog string                `json:"audit-log"`
+
+	// Where clients connect.  Without any, the broker listens for
+	// plain TCP on DefaultAddr.
+	Listeners []ListenerConfig `json:"listeners"`
+
+	// Where to serve the admin HTTP API and Prometheus metrics, if
+	// anywhere.
+	AdminAddr   string `json:"admin-addr"`
+	MetricsAddr string `json:"metrics-addr"`
+
+	// How long to wait on clients to drain when shutting down.
+	ShutdownTimeout string `json:"shutdown-timeout"`
+
+	// Limits on clients, to protect against reconnect loops and the
+	// like.  Zero means no limit.  CONNECT attempts are limited per
+	// source address, and frames per connection, both per second
+	// with bursts that default to a second's worth.
+	MaxConnections      int     `json:"max-connections"`
+	MaxConnectionsPerIP int     `json:"max-connections-per-ip"`
+	ConnectRate         float64 `json:"connect-rate"`
+	ConnectBurst        int     `json:"connect-burst"`
+	FrameRate           float64 `json:"frame-rate"`
+	FrameBurst          int     `json:"frame-burst"`
+
+	// Frame tracing.  Connections are traced from the start if Trace
+	// is set or their address matches one of TraceAddrs, or from
+	// CONNECT if their client-id header matches one of TraceClients.
+	// Patterns can use "*".  Each traced connection keeps its last
+	// TraceFrames frames, with bodies cut off at TraceBodyLimit bytes,
+	// and every traced frame goes to TraceFile if it's set, which is
+	// rotated once it reaches TraceFileSize bytes.
+	Trace          bool     `json:"trace"`
+	TraceAddrs     []string `json:"trace-addrs"`
+	TraceClients   []string `json:"trace-clients"`
+	TraceFrames    int      `json:"trace-frames"`
+	TraceBodyLimit int      `json:"trace-body-limit"`
+	TraceFile      string   `json:"trace-file"`
+	TraceFileSize  int64    `json:"trace-file-size"`
+
+	// Log levels by subsystem, e.g. {"frame": "debug"}.  Subsystems
+	// that aren't mentioned are left alone.
+	LogLevels map[string]string `json:"log-levels"`
+}
+
+type ForwardConfig struct {
+	To       string `json:"to"`
+	Selector string `json:"selector"`
+}
+
+type DestConfig struct {
+	Name string `json:"name"`
+
+	// One of "topic", "queue", or "forward" for a destination that
+	// only passes messages on.
+	Type string `json:"type"`
+
+	Forward []ForwardConfig `json:"forward"`
+
+	// Topics only.
+	Retain       bool   `json:"retain"`
+	RetainKey    string `json:"retain-key"`
+	ReplayCount  int    `json:"replay-count"`
+	ReplayBytes  int    `json:"replay-bytes"`
+	ReplayAge    string `json:"replay-age"`
+	QueueSize    int    `json:"queue-size"`
+	Overflow     string `json:"overflow"`
+	BlockTimeout string `json:"block-timeout"`
+
+	// Queues only.
+	StarvationLimit int `json:"starvation-limit"`
+
+	HighWater   int64 `json:"high-water"`
+	LowWater    int64 `json:"low-water"`
+	MemoryLimit int64 `json:"memory-limit"`
+
+	// Duplicate detection.  Without a count or an age, the last
+	// dest.DefaultDedupCount keys are remembered.
+	DedupHeader string `json:"dedup-header"`
+	DedupCount  int    `json:"dedup-count"`
+	DedupAge    string `json:"dedup-age"`
+}
+
+// DefaultConfig has an "everyone" topic and a "work" queue.
+func DefaultConfig() *Config {
+	c := &Config{}
+	c.Destinations = []DestConfig{
+		{Name: "everyone", Type: "topic"},
+		{Name: "work", Type: "queue"},
+	}
+
+	return c
+}
+
+// LoadConfig reads a JSON config file.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &Config{}
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return c, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+var overflowPolicies = map[string]dest.OverflowPolicy{
+	"":            dest.DropOldest,
+	"drop-oldest": dest.DropOldest,
+	"drop-newest": dest.DropNewest,
+	"disconnect":  dest.DisconnectConsumer,
+	"block":       dest.BlockProducer,
+}
+
+func (dc *DestConfig) build() (dest.Dest, error) {
+	var d dest.Dest
+	var usage *dest.Usage
+
+	switch dc.Type {
+	case "topic":
+		var b *dest.Broadcast
+		if id := dest.DestId(dc.Name); dest.IsVirtualTopic(id) {
+			vt := dest.NewVirtualTopic(id)
+			b = vt.Broadcast
+			d = vt
+		} else {
+			b = dest.NewBroadcast()
+			d = b
+		}
+
+		b.Retain = dc.Retain
+		b.RetainKey = dc.RetainKey
+		b.QueueSize = dc.QueueSize
+
+		policy, ok := overflowPolicies[dc.Overflow]
+		if !ok {
+			return nil, fmt.Errorf("unknown overflow policy '%s'", dc.Overflow)
+		}
+		b.Overflow = policy
+
+		timeout, err := parseDuration(dc.BlockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		b.BlockTimeout = timeout
+
+		age, err := parseDuration(dc.ReplayAge)
+		if err != nil {
+			return nil, err
+		}
+
+		if dc.ReplayCount > 0 || dc.ReplayBytes > 0 || age > 0 {
+			b.Replay = dest.NewReplayBuffer()
+			b.Replay.MaxCount = dc.ReplayCount
+			b.Replay.MaxBytes = dc.ReplayBytes
+			b.Replay.MaxAge = age
+		}
+
+		usage = b.Usage()
+
+	case "queue":
+		q := dest.NewQueue()
+		q.SetStarvationLimit(dc.StarvationLimit)
+
+		d = q
+		usage = q.Usage()
+
+	case "forward":
+		if len(dc.Forward) == 0 {
+			return nil, fmt.Errorf("forward destinations need somewhere to forward to")
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown destination type '%s'", dc.Type)
+	}
+
+	if usage != nil {
+		usage.SetWatermarks(dc.HighWater, dc.LowWater)
+		usage.SetLimit(dc.MemoryLimit)
+	}
+
+	if len(dc.Forward) == 0 {
+		return d, nil
+	}
+
+	c := dest.NewComposite(d)
+	for _, fc := range dc.Forward {
+		var sel *dest.Selector
+		if fc.Selector != "" {
+			var err error
+			if sel, err = dest.ParseSelector(fc.Selector); err != nil {
+				return nil, err
+			}
+		}
+
+		c.AddForward(dest.DestId(fc.To), sel)
+	}
+
+	return c, nil
+}
+
+// apply creates the configured destinations, and returns what it
+// created.  If one fails, the ones before it are removed again.
+func (c *Config) apply() ([]dest.DestId, error) {
+	global := dest.GlobalUsage()
+	global.SetWatermarks(c.HighWater, c.LowWater)
+	global.SetLimit(c.MemoryLimit)
+
+	var ids []dest.DestId
+	for _, dc := range c.Destinations {
+		if err := dc.add(); err != nil {
+			removeDests(ids)
+			return nil, fmt.Errorf("destination '%s': %s", dc.Name, err)
+		}
+
+		ids = append(ids, dest.DestId(dc.Name))
+	}
+
+	return ids, nil
+}
+
+func (dc *DestConfig) add() error {
+	d, err := dc.build()
+	if err != nil {
+		return err
+	}
+
+	var dd *dest.Deduper
+	if dc.DedupHeader != "" {
+		dd = dest.NewDeduper(dc.DedupHeader)
+		dd.MaxCount = dc.DedupCount
+
+		if dd.MaxAge, err = parseDuration(dc.DedupAge); err != nil {
+			return err
+		}
+	}
+
+	id := dest.DestId(dc.Name)
+	if err := dest.AddDest(id, d); err != nil {
+		return err
+	}
+
+	if dd != nil {
+		dest.SetDedup(id, dd)
+	}
+
+	return nil
+}
+
+// removeDests removes destinations, along with anything in them.
+// Ones that are already gone, say through the admin API, are skipped.
+func removeDests(ids []dest.DestId) {
+	for _, id := range ids {
+		dest.RemoveDest(id)
+	}
+}
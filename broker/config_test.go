@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"goodyear/dest"
+	"goodyear/logging"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigApply(t *testing.T) {
+	c := &Config{}
+	c.Destinations = []DestConfig{
+		{Name: "test/config-orders", Type: "queue", Forward: []ForwardConfig{
+			{To: "test/config-audit", Selector: "type = 'order'"},
+		}},
+		{Name: "test/config-audit", Type: "topic", QueueSize: 10, Overflow: "block", BlockTimeout: "1s"},
+	}
+
+	ids, err := c.apply()
+	if err != nil {
+		t.Error("config should have applied", err)
+	}
+	defer removeDests(ids)
+
+	if len(ids) != 2 {
+		t.Error("both destinations should have been created", ids)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	bad := []DestConfig{
+		{Name: "test/config-bad-type", Type: "blarg"},
+		{Name: "test/config-bad-overflow", Type: "topic", Overflow: "explode"},
+		{Name: "test/config-bad-age", Type: "topic", ReplayAge: "forever"},
+		{Name: "test/config-bad-forward", Type: "forward"},
+		{Name: "test/config-bad-selector", Type: "forward", Forward: []ForwardConfig{{To: "x", Selector: "a ="}}},
+		{Name: "test/config-cycle", Type: "forward", Forward: []ForwardConfig{{To: "test/config-cycle"}}},
+	}
+
+	for _, dc := range bad {
+		c := &Config{Destinations: []DestConfig{dc}}
+		if _, err := c.apply(); err == nil {
+			t.Errorf("%s should have failed", dc.Name)
+		}
+	}
+
+	c := &Config{Destinations: []DestConfig{{Name: "test/config-good", Type: "queue"}, bad[0]}}
+	if _, err := c.apply(); err == nil {
+		t.Error("a bad destination should fail the whole config")
+	}
+
+	if _, err := dest.Purge("test/config-good"); err == nil {
+		t.Error("the good destination should have been removed again")
+	}
+}
+
+func TestReloadLogLevels(t *testing.T) {
+	b := NewBroker()
+	defer logging.SetLevels(map[string]string{logging.Dest: "info"})
+
+	if err := b.Reload(&Config{LogLevels: map[string]string{"dest": "shouty"}}); err == nil {
+		t.Error("bad log levels should be refused")
+	}
+
+	if err := b.Reload(&Config{LogLevels: map[string]string{"dest": "debug"}}); err != nil {
+		t.Error("failed to reload", err)
+	}
+
+	if logging.Levels()[logging.Dest] != "debug" {
+		t.Error("log levels weren't applied")
+	}
+}
+
+func TestReloadAllOrNothing(t *testing.T) {
+	b := NewBroker()
+	defer logging.SetLevels(map[string]string{logging.Dest: "info"})
+
+	c := &Config{
+		Users:     map[string]UserConfig{"alice": {Passcode: "secret"}},
+		AuditLog:  filepath.Join(t.TempDir(), "audit.log"),
+		TraceFile: filepath.Join(t.TempDir(), "missing", "trace.log"),
+		LogLevels: map[string]string{"dest": "debug"},
+	}
+	if err := b.Reload(c); err == nil {
+		t.Error("a trace file that can't be opened should be refused")
+	}
+
+	if logging.Levels()[logging.Dest] == "debug" {
+		t.Error("log levels shouldn't change when the reload fails")
+	}
+
+	if b.auditFile != nil {
+		t.Error("the audit log shouldn't change when the reload fails")
+	}
+
+	if len(b.getAccessControl().users) != 0 {
+		t.Error("users shouldn't change when the reload fails")
+	}
+}
@@ -0,0 +1,230 @@
+package broker
+
+import (
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// The limits clients can run into, as they're counted in metrics.
+const (
+	limitConnections = "max-connections"
+	limitPerIP       = "max-connections-per-ip"
+	limitConnectRate = "connect-rate"
+	limitFrameRate   = "frame-rate"
+)
+
+// tokenBucket allows rate events a second on average, and bursts of up
+// to burst at once.  It isn't safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	tb := &tokenBucket{}
+	tb.rate = rate
+	tb.burst = float64(burst)
+	tb.tokens = tb.burst
+	tb.last = time.Now()
+
+	return tb
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+func (tb *tokenBucket) allow(now time.Time) bool {
+	tb.refill(now)
+	if tb.tokens < 1 {
+		return false
+	}
+
+	tb.tokens--
+
+	return true
+}
+
+// full says whether the bucket has forgotten about everything it's
+// allowed.
+func (tb *tokenBucket) full(now time.Time) bool {
+	tb.refill(now)
+
+	return tb.tokens >= tb.burst
+}
+
+// limitSettings is the part of the config about limits.  It can be
+// reloaded; connections that are already open are left alone.
+type limitSettings struct {
+	maxConns     int
+	maxPerIP     int
+	connectRate  float64
+	connectBurst int
+	frameRate    float64
+	frameBurst   int
+}
+
+// burstFor defaults a burst to a second's worth of the rate.
+func burstFor(rate float64, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+
+	return int(math.Max(1, math.Ceil(rate)))
+}
+
+func newLimitSettings(c *Config) *limitSettings {
+	ls := &limitSettings{}
+	ls.maxConns = c.MaxConnections
+	ls.maxPerIP = c.MaxConnectionsPerIP
+	ls.connectRate = c.ConnectRate
+	ls.connectBurst = burstFor(c.ConnectRate, c.ConnectBurst)
+	ls.frameRate = c.FrameRate
+	ls.frameBurst = burstFor(c.FrameRate, c.FrameBurst)
+
+	return ls
+}
+
+// ipState is what's known about one source address.
+type ipState struct {
+	conns    int
+	connects *tokenBucket
+}
+
+// connLimits counts connections, overall and by source address.
+type connLimits struct {
+	lock  sync.Mutex
+	total int
+	ips   map[string]*ipState
+}
+
+func newConnLimits() *connLimits {
+	cl := &connLimits{}
+	cl.ips = make(map[string]*ipState)
+
+	return cl
+}
+
+func remoteHost(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+
+	return host
+}
+
+// admit counts a new connection from ip, unless that would put it
+// over a limit, in which case it says which one.
+func (cl *connLimits) admit(ls *limitSettings, ip string) string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	st := cl.ips[ip]
+
+	switch {
+	case ls.maxConns > 0 && cl.total >= ls.maxConns:
+		return limitConnections
+	case ls.maxPerIP > 0 && st != nil && st.conns >= ls.maxPerIP:
+		return limitPerIP
+	}
+
+	if st == nil {
+		st = &ipState{}
+		cl.ips[ip] = st
+	}
+
+	st.conns++
+	cl.total++
+
+	return ""
+}
+
+// release forgets a connection from ip.  Addresses with nothing open
+// are forgotten too once their CONNECT allowance has filled back up,
+// so a reconnect loop can't dodge the limit.
+func (cl *connLimits) release(ip string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if st := cl.ips[ip]; st != nil {
+		st.conns--
+	}
+	cl.total--
+
+	now := time.Now()
+	for addr, st := range cl.ips {
+		if st.conns == 0 && (st.connects == nil || st.connects.full(now)) {
+			delete(cl.ips, addr)
+		}
+	}
+}
+
+// allowConnect takes a CONNECT attempt from ip out of its allowance.
+func (cl *connLimits) allowConnect(ls *limitSettings, ip string) bool {
+	if ls.connectRate <= 0 {
+		return true
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	st := cl.ips[ip]
+	if st == nil {
+		st = &ipState{}
+		cl.ips[ip] = st
+	}
+
+	if st.connects == nil {
+		st.connects = newTokenBucket(ls.connectRate, ls.connectBurst)
+	}
+
+	return st.connects.allow(time.Now())
+}
+
+func (b *Broker) setLimits(ls *limitSettings) {
+	b.limitSettings.Store(ls)
+}
+
+func (b *Broker) getLimits() *limitSettings {
+	ls, _ := b.limitSettings.Load().(*limitSettings)
+	if ls == nil {
+		return &limitSettings{}
+	}
+
+	return ls
+}
+
+var refusals = map[string]string{
+	limitConnections: "too many connections, try again later",
+	limitPerIP:       "too many connections from your address",
+}
+
+// refuse tells a client it's over a limit and hangs up, without
+// holding up the accept loop.  done is called once it's closed.
+func (b *Broker) refuse(conn net.Conn, remote, limit string, done func()) {
+	b.metrics.limited.With(limit).Inc()
+	serverLog.Warn("refused connection", "remote", remote, "limit", limit)
+
+	go func() {
+		defer done()
+
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(errorFrame(nil, refusals[limit]).Bytes())
+
+		// Closing with the client's CONNECT unread could reset the
+		// connection before it sees the ERROR, so hang up our side
+		// and let it finish first.
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+			io.Copy(io.Discard, conn)
+		}
+		conn.Close()
+	}()
+}
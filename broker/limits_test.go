@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"goodyear/frame"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(1, 2)
+	now := tb.last
+
+	if !tb.allow(now) || !tb.allow(now) {
+		t.Error("a burst should be allowed")
+	}
+
+	if tb.allow(now) {
+		t.Error("the burst should be used up")
+	}
+
+	if !tb.allow(now.Add(time.Second)) {
+		t.Error("the bucket should have refilled")
+	}
+
+	if tb.full(now.Add(time.Second)) || !tb.full(now.Add(3*time.Second)) {
+		t.Error("the bucket should fill back up to the burst")
+	}
+}
+
+// expectError connects and sends a CONNECT, and expects to be thrown
+// off with an ERROR.
+func expectError(t *testing.T, l net.Listener, why string) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("failed to connect", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	conn.Write(BF("CONNECT", hdr{"accept-version": "1.2"}, "").Bytes())
+
+	f, err := frame.NewFrameFromReader(bufio.NewReader(conn))
+	if err != nil || f.Cmd != "ERROR" {
+		t.Error(why, err)
+		return
+	}
+
+	if _, ok := f.Headers.Get("message"); !ok {
+		t.Error("the ERROR should say what went wrong")
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	b, l := startBroker(t, &Config{MaxConnectionsPerIP: 1})
+	defer b.Shutdown(context.Background())
+
+	conn, _ := dialBroker(t, l)
+	expectError(t, l, "a second connection should be refused")
+	conn.Close()
+
+	// Once the first one has gone there's room again.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.clients()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, _ = dialBroker(t, l)
+	conn.Close()
+}
+
+func TestConnectRate(t *testing.T) {
+	b, l := startBroker(t, &Config{ConnectRate: 0.01})
+	defer b.Shutdown(context.Background())
+
+	conn, _ := dialBroker(t, l)
+	defer conn.Close()
+
+	expectError(t, l, "connecting again straight away should be refused")
+}
+
+func TestFrameRate(t *testing.T) {
+	c := &Config{FrameRate: 0.01, FrameBurst: 2}
+	c.Destinations = []DestConfig{{Name: "test/limits-queue", Type: "queue"}}
+
+	b, l := startBroker(t, c)
+	defer b.Shutdown(context.Background())
+
+	conn, r := dialBroker(t, l)
+	defer conn.Close()
+
+	conn.Write(BF("SEND", hdr{"destination": "test/limits-queue", "receipt": "1"}, "").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "RECEIPT" {
+		t.Error("the burst should have been allowed", err)
+	}
+
+	conn.Write(BF("SEND", hdr{"destination": "test/limits-queue", "receipt": "2"}, "").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "ERROR" {
+		t.Error("going over the frame rate should get an ERROR", err)
+	}
+}
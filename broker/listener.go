@@ -0,0 +1,202 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"goodyear/frame"
+	"net"
+	"os"
+)
+
+// DefaultAddr is where the broker listens if it isn't told otherwise.
+const DefaultAddr = ":61613"
+
+// ListenerConfig describes one place the broker listens, and what's
+// asked of the clients that connect there.
+type ListenerConfig struct {
+	Name string `json:"name"`
+
+	// One of "tcp", "tls", "unix" or "websocket".
+	Type string `json:"type"`
+
+	// A host and port, or a socket path for "unix".
+	Addr string `json:"addr"`
+
+	// The certificate for "tls", and for "websocket" to serve wss.
+	CertFile string `json:"cert-file"`
+	KeyFile  string `json:"key-file"`
+
+	// The HTTP path WebSocket clients connect to, "/" by default.
+	Path string `json:"path"`
+
+	RequireLogin bool     `json:"require-login"`
+	MaxHeaders   int      `json:"max-headers"`
+	MaxBodySize  int      `json:"max-body-size"`
+	Destinations []string `json:"destinations"`
+}
+
+// ListenerPolicy is what's asked of clients on one listener, on top of
+// access control.
+type ListenerPolicy struct {
+	// Clients have to log in as one of the configured users.
+	RequireLogin bool
+
+	// Frames over these limits close the connection.  Zero means no
+	// limit.
+	MaxHeaders  int
+	MaxBodySize int
+
+	// Patterns for the destinations clients can SEND to and SUBSCRIBE
+	// to.  With none, they can use any.
+	Destinations []string
+}
+
+func (p *ListenerPolicy) frameLimits() frame.Limits {
+	return frame.Limits{MaxHeaders: p.MaxHeaders, MaxBodySize: p.MaxBodySize}
+}
+
+func (p *ListenerPolicy) allows(dst string) bool {
+	return len(p.Destinations) == 0 || matchAny(p.Destinations, dst)
+}
+
+// Listener is a net.Listener with a name and a policy for its clients.
+// Serving a plain net.Listener is the same as serving one with an
+// empty policy.
+type Listener struct {
+	net.Listener
+	Name   string
+	Policy ListenerPolicy
+}
+
+func (lc *ListenerConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// listenUnix listens on a socket path, clearing away a socket left
+// behind by a broker that didn't get to clean up.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+func (lc *ListenerConfig) listen() (*Listener, error) {
+	var (
+		l   net.Listener
+		err error
+	)
+
+	switch lc.Type {
+	case "", "tcp":
+		l, err = net.Listen("tcp", lc.Addr)
+	case "tls":
+		var tc *tls.Config
+		if tc, err = lc.tlsConfig(); err == nil {
+			l, err = tls.Listen("tcp", lc.Addr, tc)
+		}
+	case "unix":
+		l, err = listenUnix(lc.Addr)
+	case "websocket":
+		var tc *tls.Config
+		if lc.CertFile != "" {
+			if tc, err = lc.tlsConfig(); err != nil {
+				break
+			}
+		}
+
+		if l, err = net.Listen("tcp", lc.Addr); err == nil {
+			if tc != nil {
+				l = tls.NewListener(l, tc)
+			}
+			l = newWSListener(l, lc.Path)
+		}
+	default:
+		err = fmt.Errorf("unknown type '%s'", lc.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	name := lc.Name
+	if name == "" {
+		name = l.Addr().String()
+	}
+
+	return &Listener{
+		Listener: l,
+		Name:     name,
+		Policy: ListenerPolicy{
+			RequireLogin: lc.RequireLogin,
+			MaxHeaders:   lc.MaxHeaders,
+			MaxBodySize:  lc.MaxBodySize,
+			Destinations: lc.Destinations,
+		},
+	}, nil
+}
+
+// Listen opens every listener in the config, or plain TCP on
+// DefaultAddr if there aren't any.  If one can't be opened, none are
+// left open.
+func (b *Broker) Listen() ([]*Listener, error) {
+	var lcs []ListenerConfig
+	if b.Config != nil {
+		lcs = b.Config.Listeners
+	}
+
+	if len(lcs) == 0 {
+		lcs = []ListenerConfig{{Name: "default", Type: "tcp", Addr: DefaultAddr}}
+	}
+
+	var ls []*Listener
+	for i := range lcs {
+		l, err := lcs[i].listen()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listener '%s': %s", lcs[i].Name, err)
+		}
+
+		serverLog.Info("listening", "listener", l.Name, "type", lcs[i].Type, "addr", l.Addr().String())
+		ls = append(ls, l)
+	}
+
+	return ls, nil
+}
+
+// ListenAndServe opens the configured listeners and serves them all.
+// Like Serve, it returns ErrBrokerClosed once the broker is shut down,
+// or the first error from a listener failing.
+func (b *Broker) ListenAndServe() error {
+	ls, err := b.Listen()
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l *Listener) {
+			errs <- b.Serve(l)
+		}(l)
+	}
+
+	for range ls {
+		if err := <-errs; err != ErrBrokerClosed {
+			return err
+		}
+	}
+
+	return ErrBrokerClosed
+}
@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"goodyear/frame"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveListeners starts a broker serving everything in c.Listeners.
+func serveListeners(t *testing.T, c *Config) (*Broker, []*Listener) {
+	b := NewBroker()
+	b.Config = c
+	if err := b.Start(); err != nil {
+		t.Error("failed to start", err)
+		t.FailNow()
+	}
+
+	ls, err := b.Listen()
+	if err != nil {
+		t.Error("failed to listen", err)
+		t.FailNow()
+	}
+
+	for _, l := range ls {
+		go b.Serve(l)
+	}
+
+	return b, ls
+}
+
+func TestListenerPolicy(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "goodyear.sock")
+
+	c := &Config{}
+	c.Destinations = []DestConfig{{Name: "test/sidecar-queue", Type: "queue"}, {Name: "test/private-queue", Type: "queue"}}
+	c.Users = map[string]UserConfig{"alice": {Passcode: "secret"}}
+	c.Listeners = []ListenerConfig{
+		{Name: "internal", Type: "tcp", Addr: "127.0.0.1:0"},
+		{Name: "sidecar", Type: "unix", Addr: sock, RequireLogin: true, MaxBodySize: 4,
+			Destinations: []string{"test/sidecar-*"}},
+	}
+
+	b, ls := serveListeners(t, c)
+	defer b.Shutdown(context.Background())
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Error("failed to connect", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	conn.Write(BF("CONNECT", hdr{"accept-version": "1.2"}, "").Bytes())
+	if f, err := frame.NewFrameFromReader(bufio.NewReader(conn)); err != nil || f.Cmd != "ERROR" {
+		t.Error("the sidecar listener should require a login", err)
+	}
+
+	conn, r := dialBrokerAs(t, ls[1], "alice")
+	defer conn.Close()
+
+	conn.Write(BF("SEND", hdr{"destination": "test/private-queue", "receipt": "1"}, "").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "ERROR" {
+		t.Error("only the sidecar destinations should be allowed", err)
+	}
+
+	conn.Write(BF("SEND", hdr{"destination": "test/sidecar-queue", "receipt": "2"}, "hi").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "RECEIPT" {
+		t.Error("sending to a sidecar destination should work", err)
+	}
+
+	conn.Write(BF("SEND", hdr{"destination": "test/sidecar-queue"}, "hello").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "ERROR" {
+		t.Error("too big a frame should be refused", err)
+	}
+
+	// None of that applies to the internal listener.
+	other, r := dialBrokerAs(t, ls[0], "alice")
+	defer other.Close()
+
+	other.Write(BF("SEND", hdr{"destination": "test/private-queue", "receipt": "1"}, "hello").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "RECEIPT" {
+		t.Error("the internal listener shouldn't be limited", err)
+	}
+
+	var internal bool
+	for _, cs := range b.clients() {
+		internal = internal || cs.listener == "internal"
+	}
+
+	if !internal {
+		t.Error("connections should know their listener")
+	}
+}
+
+// wsWrite sends a masked frame, the way a client has to.
+func wsWrite(w io.Writer, opcode byte, fin bool, payload []byte) {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+
+	hdr := []byte{b0, 0x80 | byte(len(payload))}
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+
+	w.Write(append(append(hdr, mask...), masked...))
+}
+
+func wsRead(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Error("failed to read a frame", err)
+		t.FailNow()
+	}
+
+	length := int(hdr[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+
+	payload := make([]byte, length)
+	io.ReadFull(r, payload)
+
+	return hdr[0] & 0x0f, payload
+}
+
+func TestWebSocket(t *testing.T) {
+	c := &Config{}
+	c.Listeners = []ListenerConfig{{Name: "browsers", Type: "websocket", Addr: "127.0.0.1:0", Path: "/stomp"}}
+
+	b, ls := serveListeners(t, c)
+	defer b.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", ls[0].Addr().String())
+	if err != nil {
+		t.Error("failed to connect", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest("GET", "http://"+ls[0].Addr().String()+"/stomp", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", "v10.stomp, v12.stomp")
+	req.Write(conn)
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Error("the upgrade failed", err)
+		t.FailNow()
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" || resp.Header.Get("Sec-WebSocket-Protocol") != "v12.stomp" {
+		t.Error("the handshake response is wrong", resp.Header)
+	}
+
+	// A frame split across messages, with a ping in the middle.
+	connect := BF("CONNECT", hdr{"accept-version": "1.2"}, "").Bytes()
+	wsWrite(conn, wsText, false, connect[:5])
+	wsWrite(conn, wsPing, true, []byte("ping"))
+	wsWrite(conn, wsContinuation, true, connect[5:])
+
+	if op, payload := wsRead(t, r); op != wsPong || string(payload) != "ping" {
+		t.Error("the ping wasn't answered", op)
+	}
+
+	op, payload := wsRead(t, r)
+	f, err := frame.NewFrameFromReader(bufio.NewReader(bytes.NewReader(payload)))
+	if op != wsText || err != nil || f.Cmd != "CONNECTED" {
+		t.Error("didn't get connected over a websocket", op, err)
+	}
+
+	wsWrite(conn, wsClose, true, []byte{0x03, 0xe8})
+	if op, _ := wsRead(t, r); op != wsClose {
+		t.Error("the close wasn't answered", op)
+	}
+}
+
+// writeCert makes a self-signed certificate for localhost.
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Error("failed to make a certificate", err)
+		t.FailNow()
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestTLSListener(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir())
+
+	c := &Config{}
+	c.Listeners = []ListenerConfig{{Name: "partners", Type: "tls", Addr: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile}}
+
+	b, ls := serveListeners(t, c)
+	defer b.Shutdown(context.Background())
+
+	conn, err := tls.Dial("tcp", ls[0].Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Error("failed to connect", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	conn.Write(BF("CONNECT", hdr{"accept-version": "1.2"}, "").Bytes())
+	if f, err := frame.NewFrameFromReader(bufio.NewReader(conn)); err != nil || f.Cmd != "CONNECTED" {
+		t.Error("didn't get connected over TLS", err)
+	}
+}
+
+func TestListenErrors(t *testing.T) {
+	b := NewBroker()
+	b.Config = &Config{Listeners: []ListenerConfig{
+		{Name: "ok", Type: "tcp", Addr: "127.0.0.1:0"},
+		{Name: "bad", Type: "carrier-pigeon"},
+	}}
+
+	if _, err := b.Listen(); err == nil {
+		t.Error("unknown listener types should fail")
+	}
+
+	b.Config.Listeners[1] = ListenerConfig{Name: "no-cert", Type: "tls", Addr: "127.0.0.1:0"}
+	if _, err := b.Listen(); err == nil {
+		t.Error("tls without a certificate should fail")
+	}
+}
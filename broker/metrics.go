@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"errors"
+	"goodyear/dest"
+	"goodyear/frame"
+	"goodyear/metrics"
+	"io"
+	"net"
+	"net/http"
+)
+
+type brokerMetrics struct {
+	accepted    metrics.Counter
+	framesIn    *metrics.CounterVec
+	framesOut   *metrics.CounterVec
+	bytesIn     metrics.Counter
+	bytesOut    metrics.Counter
+	parseErrors *metrics.CounterVec
+	limited     *metrics.CounterVec
+}
+
+func newBrokerMetrics() *brokerMetrics {
+	m := &brokerMetrics{}
+	m.framesIn = metrics.NewCounterVec()
+	m.framesOut = metrics.NewCounterVec()
+	m.parseErrors = metrics.NewCounterVec()
+	m.limited = metrics.NewCounterVec()
+
+	return m
+}
+
+// countingReader counts the bytes read from a connection.
+type countingReader struct {
+	r io.Reader
+	c *metrics.Counter
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.c.Add(uint64(n))
+
+	return n, err
+}
+
+// parseErrorKind sorts out why a frame couldn't be read.  The client
+// going away doesn't count.
+func parseErrorKind(err error) string {
+	switch {
+	case err == io.EOF, errors.Is(err, net.ErrClosed):
+		return ""
+	case err == frame.ErrNoDelimiter:
+		return "header"
+	case err == frame.ErrContentLength:
+		return "content-length"
+	case err == frame.ErrShortBody, err == frame.ErrBodyTerminator:
+		return "body"
+	case err == frame.ErrTooLarge:
+		return "too-large"
+	}
+
+	return "read"
+}
+
+// clientCommands are the commands a client can send.  Frames are only
+// counted by command if it's one of these, so clients can't make up
+// new label values.
+var clientCommands = map[string]bool{
+	"CONNECT": true, "STOMP": true, "SEND": true, "SUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "ACK": true, "NACK": true, "BEGIN": true,
+	"COMMIT": true, "ABORT": true, "DISCONNECT": true,
+}
+
+func commandLabel(cmd string) string {
+	if clientCommands[cmd] {
+		return cmd
+	}
+
+	return "other"
+}
+
+func (m *brokerMetrics) parseError(err error) {
+	if kind := parseErrorKind(err); kind != "" {
+		m.parseErrors.With(kind).Inc()
+	}
+}
+
+func writeCounterVec(w *metrics.Writer, name, help, label string, v *metrics.CounterVec) {
+	values, counts := v.Values()
+	for i, value := range values {
+		w.Counter(name, help, counts[i], metrics.Label{Name: label, Value: value})
+	}
+}
+
+// MetricsHandler serves the broker's metrics in the Prometheus text
+// format.
+func (b *Broker) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		b.writeMetrics(metrics.NewWriter(rw))
+	})
+}
+
+func (b *Broker) writeMetrics(w *metrics.Writer) {
+	m := b.metrics
+
+	phases := make(map[clientStatePhase]int)
+	for _, cs := range b.clients() {
+		phases[cs.getPhase()]++
+	}
+
+	for _, p := range []clientStatePhase{opened, connected, disconnected, errorPhase} {
+		w.Gauge("goodyear_connections", "Open connections by phase.", float64(phases[p]), metrics.Label{Name: "phase", Value: p.String()})
+	}
+
+	w.Counter("goodyear_connections_accepted_total", "Connections accepted.", m.accepted.Value())
+	writeCounterVec(w, "goodyear_frames_received_total", "Frames received by command.", "command", m.framesIn)
+	writeCounterVec(w, "goodyear_frames_sent_total", "Frames sent by command.", "command", m.framesOut)
+	w.Counter("goodyear_received_bytes_total", "Bytes read from clients.", m.bytesIn.Value())
+	w.Counter("goodyear_sent_bytes_total", "Bytes written to clients.", m.bytesOut.Value())
+	writeCounterVec(w, "goodyear_frame_parse_errors_total", "Frames that couldn't be read, by what was wrong.", "type", m.parseErrors)
+	writeCounterVec(w, "goodyear_limited_total", "Connections refused or closed for going over a limit.", "limit", m.limited)
+
+	var infos []dest.DestInfo
+	for _, id := range dest.List("") {
+		if info, err := dest.Describe(id); err == nil {
+			infos = append(infos, info)
+		}
+	}
+
+	label := func(info dest.DestInfo) metrics.Label {
+		return metrics.Label{Name: "destination", Value: string(info.Id)}
+	}
+
+	for _, info := range infos {
+		w.Counter("goodyear_messages_enqueued_total", "Messages sent to a destination.", info.Enqueued, label(info))
+	}
+	for _, info := range infos {
+		w.Counter("goodyear_messages_delivered_total", "Messages delivered to subscribers.", info.Delivered, label(info))
+	}
+	for _, info := range infos {
+		w.Counter("goodyear_messages_acked_total", "Deliveries that were ACKed.", info.Acked, label(info))
+	}
+	for _, info := range infos {
+		w.Counter("goodyear_messages_nacked_total", "Deliveries that were NACKed.", info.Nacked, label(info))
+	}
+	for _, info := range infos {
+		w.Gauge("goodyear_destination_depth", "Messages waiting to be delivered.", float64(info.Depth), label(info))
+	}
+	for _, info := range infos {
+		w.Gauge("goodyear_destination_subscribers", "Subscribers to a destination.", float64(info.Subscribers), label(info))
+	}
+	for _, info := range infos {
+		w.Gauge("goodyear_destination_memory_bytes", "Bytes held by a destination's messages.", float64(info.Usage.Used), label(info))
+	}
+	for _, info := range infos {
+		w.Histogram("goodyear_dispatch_latency_seconds", "Time from a message being sent to being delivered.", info.Latency, label(info))
+	}
+
+	w.Gauge("goodyear_memory_bytes", "Bytes held by messages across the broker.", float64(dest.GlobalUsage().Used()))
+	w.Gauge("goodyear_scheduled_messages", "Messages waiting on a delay.", float64(dest.ScheduledCount()))
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"context"
+	"goodyear/frame"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	c := &Config{Destinations: []DestConfig{{Name: "test/metrics", Type: "queue"}}}
+	b, l := startBroker(t, c)
+	defer b.Shutdown(context.Background())
+
+	srv := httptest.NewServer(b.MetricsHandler())
+	defer srv.Close()
+
+	conn, r := dialBroker(t, l)
+	defer conn.Close()
+
+	conn.Write(BF("SUBSCRIBE", hdr{"id": "0", "destination": "test/metrics", "ack": "client"}, "").Bytes())
+	conn.Write(BF("SEND", hdr{"destination": "test/metrics"}, "hi").Bytes())
+
+	f, err := frame.NewFrameFromReader(r)
+	if err != nil || f.Cmd != "MESSAGE" {
+		t.Error("message wasn't delivered", err)
+		t.FailNow()
+	}
+
+	ack, _ := f.Headers.Get("ack")
+	conn.Write(BF("ACK", hdr{"id": ack, "receipt": "1"}, "").Bytes())
+	if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != "RECEIPT" {
+		t.Error("ack failed", err)
+	}
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Error("failed to scrape", err)
+		t.FailNow()
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`goodyear_connections{phase="connected"} 1`,
+		`goodyear_connections_accepted_total 1`,
+		`goodyear_frames_received_total{command="SEND"} 1`,
+		`goodyear_frames_sent_total{command="MESSAGE"} 1`,
+		`goodyear_messages_enqueued_total{destination="test/metrics"} 1`,
+		`goodyear_messages_delivered_total{destination="test/metrics"} 1`,
+		`goodyear_messages_acked_total{destination="test/metrics"} 1`,
+		`goodyear_destination_subscribers{destination="test/metrics"} 1`,
+		`goodyear_dispatch_latency_seconds_count{destination="test/metrics"} 1`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Error("metrics are missing", line)
+		}
+	}
+}
+
+func TestParseErrorKind(t *testing.T) {
+	if parseErrorKind(io.EOF) != "" {
+		t.Error("a client hanging up isn't a parse error")
+	}
+
+	if parseErrorKind(frame.ErrNoDelimiter) != "header" || parseErrorKind(frame.ErrBodyTerminator) != "body" {
+		t.Error("parse errors were sorted wrong")
+	}
+}
+
+func TestCommandLabel(t *testing.T) {
+	if commandLabel("SEND") != "SEND" || commandLabel("JUNK1") != "other" || commandLabel("send") != "other" {
+		t.Error("commands were labelled wrong")
+	}
+}
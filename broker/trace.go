@@ -0,0 +1,332 @@
+package broker
+
+import (
+	"encoding/json"
+	"goodyear/frame"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTraceFrames    = 100
+	defaultTraceBodyLimit = 256
+	defaultTraceFileSize  = 10 << 20
+)
+
+const (
+	traceIn  = "in"
+	traceOut = "out"
+)
+
+// traceEntry is one frame sent or received by a traced connection.
+// Bodies are cut off at the configured limit, but BodyLength is always
+// the real length.
+type traceEntry struct {
+	Time       time.Time         `json:"time"`
+	Conn       int               `json:"conn"`
+	Direction  string            `json:"direction"`
+	Command    string            `json:"command"`
+	Headers    frame.FrameHeader `json:"headers"`
+	Body       string            `json:"body"`
+	BodyLength int               `json:"body-length"`
+}
+
+// traceSettings is the part of the config about tracing.  Like access
+// control, it can be reloaded, but connections keep whatever tracing
+// they started with.
+type traceSettings struct {
+	all       bool
+	addrs     []string
+	clients   []string
+	frames    int
+	bodyLimit int
+}
+
+func newTraceSettings(c *Config) *traceSettings {
+	ts := &traceSettings{}
+	ts.all = c.Trace
+	ts.addrs = c.TraceAddrs
+	ts.clients = c.TraceClients
+
+	ts.frames = c.TraceFrames
+	if ts.frames <= 0 {
+		ts.frames = defaultTraceFrames
+	}
+
+	ts.bodyLimit = c.TraceBodyLimit
+	if ts.bodyLimit <= 0 {
+		ts.bodyLimit = defaultTraceBodyLimit
+	}
+
+	return ts
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tracesAddr says whether a connection from remote, an address with a
+// port, should be traced from the start.  Patterns match the host.
+func (ts *traceSettings) tracesAddr(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+
+	return ts.all || matchAny(ts.addrs, host)
+}
+
+func (ts *traceSettings) tracesClient(clientId string) bool {
+	return matchAny(ts.clients, clientId)
+}
+
+// connTrace keeps a connection's most recent frames while it's being
+// traced.
+type connTrace struct {
+	on int32
+
+	lock    sync.Mutex
+	entries []traceEntry
+	next    int
+}
+
+func (ct *connTrace) enabled() bool {
+	return atomic.LoadInt32(&ct.on) != 0
+}
+
+func (ct *connTrace) setEnabled(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+
+	atomic.StoreInt32(&ct.on, v)
+}
+
+func (ct *connTrace) add(e traceEntry, max int) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	if len(ct.entries) == max {
+		ct.entries[ct.next%max] = e
+		ct.next++
+		return
+	}
+
+	// Either there's still room, or max changed on a reload and the
+	// ring has to grow or shrink, which only works oldest first.
+	entries := ct.inOrder()
+	if len(entries) >= max {
+		entries = entries[len(entries)-max+1:]
+	}
+	ct.entries = append(entries, e)
+	ct.next = 0
+}
+
+// frames returns what's been recorded, oldest first.
+func (ct *connTrace) frames() []traceEntry {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	return append([]traceEntry(nil), ct.inOrder()...)
+}
+
+// inOrder returns the entries oldest first, which is how they're
+// stored until the ring wraps.
+// Must be called with the lock held.
+func (ct *connTrace) inOrder() []traceEntry {
+	n := len(ct.entries)
+	if n == 0 || ct.next%n == 0 {
+		return ct.entries
+	}
+
+	entries := make([]traceEntry, 0, n)
+	for i := 0; i < n; i++ {
+		entries = append(entries, ct.entries[(ct.next+i)%n])
+	}
+
+	return entries
+}
+
+// rotatingFile appends to a file, moving it aside to <path>.1 when it
+// would grow past max bytes.  Only one old file is kept.  If the file
+// can't be reopened after rotating, the next write tries again.
+type rotatingFile struct {
+	lock   sync.Mutex
+	path   string
+	max    int64
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+func openRotatingFile(path string, max int64) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, max: max}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// Must be called with the lock held.
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f = f
+	rf.size = st.Size()
+
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+
+	if rf.f != nil && rf.size > 0 && rf.size+int64(len(p)) > rf.max {
+		rf.rotate()
+	}
+
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// rotate moves the file aside, leaving Write to open a new one.  If it
+// can't be moved, we carry on appending to it, and try again once it's
+// grown by another max bytes.
+// Must be called with the lock held.
+func (rf *rotatingFile) rotate() {
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		serverLog.Warn("failed to rotate trace file", "path", rf.path, "err", err)
+		rf.size = 0
+		return
+	}
+
+	rf.f.Close()
+	rf.f = nil
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	rf.closed = true
+	if rf.f == nil {
+		return nil
+	}
+
+	err := rf.f.Close()
+	rf.f = nil
+
+	return err
+}
+
+// openTraceFile opens the file traced frames are written to, if the
+// config names one.
+func openTraceFile(c *Config) (*rotatingFile, error) {
+	if c.TraceFile == "" {
+		return nil, nil
+	}
+
+	size := c.TraceFileSize
+	if size <= 0 {
+		size = defaultTraceFileSize
+	}
+
+	return openRotatingFile(c.TraceFile, size)
+}
+
+// traceState is the settings and the file together, so traceFrame can
+// get both without taking a lock on every frame.
+type traceState struct {
+	settings *traceSettings
+	file     *rotatingFile
+}
+
+// setTracing swaps in new settings and closes the old file.  A frame
+// being traced at the same time may miss out on being written.
+func (b *Broker) setTracing(ts *traceSettings, f *rotatingFile) {
+	old, _ := b.tracing.Swap(&traceState{ts, f}).(*traceState)
+	if old != nil && old.file != nil {
+		old.file.Close()
+	}
+}
+
+func (b *Broker) getTracing() (*traceSettings, *rotatingFile) {
+	t, _ := b.tracing.Load().(*traceState)
+	if t == nil {
+		return newTraceSettings(&Config{}), nil
+	}
+
+	return t.settings, t.file
+}
+
+// traceFrame records a frame if the connection is being traced.  A
+// CONNECT whose client-id matches the config turns tracing on.
+func (cs *clientState) traceFrame(direction string, f *frame.Frame) {
+	ts, file := cs.broker.getTracing()
+
+	if direction == traceIn && (f.Cmd == "CONNECT" || f.Cmd == "STOMP") {
+		if id, ok := f.Headers.Get("client-id"); ok && ts.tracesClient(id) {
+			cs.trace.setEnabled(true)
+		}
+	}
+
+	if !cs.trace.enabled() {
+		return
+	}
+
+	e := traceEntry{
+		Time:       time.Now(),
+		Conn:       cs.id,
+		Direction:  direction,
+		Command:    f.Cmd,
+		Headers:    redactHeaders(f.Headers),
+		BodyLength: len(f.Body),
+	}
+
+	body := f.Body
+	if len(body) > ts.bodyLimit {
+		body = body[:ts.bodyLimit]
+	}
+	e.Body = string(body)
+
+	cs.trace.add(e, ts.frames)
+
+	if file != nil {
+		line, _ := json.Marshal(e)
+		if _, err := file.Write(append(line, '\n')); err != nil && err != os.ErrClosed {
+			cs.getLog().Warn("failed to write trace", "err", err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"goodyear/frame"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestTraceRing(t *testing.T) {
+	ct := &connTrace{}
+	for i := 0; i < 5; i++ {
+		ct.add(traceEntry{Conn: i}, 3)
+	}
+
+	frames := ct.frames()
+	if len(frames) != 3 || frames[0].Conn != 2 || frames[1].Conn != 3 || frames[2].Conn != 4 {
+		t.Error("only the last frames should be kept, oldest first", frames)
+	}
+}
+
+func TestTraceRingResize(t *testing.T) {
+	conns := func(frames []traceEntry) []int {
+		var ids []int
+		for _, f := range frames {
+			ids = append(ids, f.Conn)
+		}
+		return ids
+	}
+
+	ct := &connTrace{}
+	for i := 0; i < 5; i++ {
+		ct.add(traceEntry{Conn: i}, 3)
+	}
+
+	// Growing after the ring has wrapped keeps the order.
+	ct.add(traceEntry{Conn: 5}, 5)
+	if ids := conns(ct.frames()); len(ids) != 4 || ids[0] != 2 || ids[3] != 5 {
+		t.Error("growing the ring mixed up the frames", ids)
+	}
+
+	// Shrinking drops the oldest.
+	ct.add(traceEntry{Conn: 6}, 2)
+	if ids := conns(ct.frames()); len(ids) != 2 || ids[0] != 5 || ids[1] != 6 {
+		t.Error("shrinking the ring kept the wrong frames", ids)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.log")
+
+	rf, err := openRotatingFile(path, 10)
+	if err != nil {
+		t.Error("failed to open", err)
+		t.FailNow()
+	}
+	defer rf.Close()
+
+	rf.Write([]byte("0123456\n"))
+	rf.Write([]byte("789\n"))
+
+	old, _ := os.ReadFile(path + ".1")
+	cur, _ := os.ReadFile(path)
+	if string(old) != "0123456\n" || string(cur) != "789\n" {
+		t.Errorf("file wasn't rotated: %q %q", old, cur)
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.log")
+
+	// A directory with something in it can't be renamed over.
+	os.MkdirAll(filepath.Join(path+".1", "x"), 0700)
+
+	rf, err := openRotatingFile(path, 10)
+	if err != nil {
+		t.Error("failed to open", err)
+		t.FailNow()
+	}
+	defer rf.Close()
+
+	rf.Write([]byte("0123456\n"))
+	if _, err := rf.Write([]byte("789\n")); err != nil {
+		t.Error("writes should carry on when rotating fails", err)
+	}
+
+	if cur, _ := os.ReadFile(path); string(cur) != "0123456\n789\n" {
+		t.Errorf("the file should have kept growing: %q", cur)
+	}
+
+	rf.Close()
+	if _, err := rf.Write([]byte("x")); err != os.ErrClosed {
+		t.Error("writing after closing should fail", err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.log")
+
+	c := &Config{}
+	c.Destinations = []DestConfig{{Name: "test/trace-queue", Type: "queue"}}
+	c.Users = map[string]UserConfig{"alice": {Passcode: "secret"}}
+	c.ACLs = []ACLRule{{Principal: "alice", Destination: "*", Permissions: []string{"read", "write", "admin"}}}
+	c.TraceClients = []string{"orders-*"}
+	c.TraceBodyLimit = 4
+	c.TraceFile = path
+
+	b, l := startBroker(t, c)
+	defer b.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("failed to connect", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	conn.Write(BF("CONNECT", hdr{"accept-version": "1.2", "login": "alice", "passcode": "secret", "client-id": "orders-1"}, "").Bytes())
+	conn.Write(BF("SEND", hdr{"destination": "test/trace-queue", "receipt": "1"}, "hello world").Bytes())
+
+	for _, cmd := range []string{"CONNECTED", "RECEIPT"} {
+		if f, err := frame.NewFrameFromReader(r); err != nil || f.Cmd != cmd {
+			t.Error("expected", cmd, err)
+			t.FailNow()
+		}
+	}
+
+	other, _ := dialBrokerAs(t, l, "alice")
+	defer other.Close()
+
+	var traced, untraced *clientState
+	for _, cs := range b.clients() {
+		if cs.trace.enabled() {
+			traced = cs
+		} else {
+			untraced = cs
+		}
+	}
+
+	if traced == nil || untraced == nil {
+		t.Error("only the matching client should be traced")
+		t.FailNow()
+	}
+
+	frames := traced.trace.frames()
+	if len(frames) != 4 {
+		t.Error("every frame should have been recorded", frames)
+		t.FailNow()
+	}
+
+	// The reader and writer record independently, so the order
+	// between directions isn't fixed.
+	byCmd := make(map[string]traceEntry)
+	for _, e := range frames {
+		byCmd[e.Command] = e
+	}
+
+	send := byCmd["SEND"]
+	if send.Direction != traceIn || send.Body != "hell" || send.BodyLength != 11 {
+		t.Error("SEND wasn't recorded properly", send)
+	}
+
+	if byCmd["CONNECT"].Direction != traceIn || byCmd["RECEIPT"].Direction != traceOut {
+		t.Error("frames weren't recorded in the right direction", frames)
+	}
+
+	if v, _ := byCmd["CONNECT"].Headers.Get("passcode"); v == "secret" {
+		t.Error("the passcode shouldn't be recorded")
+	}
+
+	if data, _ := os.ReadFile(path); bytes.Count(data, []byte("\n")) != 4 || bytes.Contains(data, []byte("secret")) {
+		t.Errorf("trace file is wrong: %s", data)
+	}
+
+	// Tracing can be turned on for anyone through the admin API.
+	srv := httptest.NewServer(b.AdminHandler())
+	defer srv.Close()
+
+	resp := adminRequest(t, srv, "POST", "/connections/"+strconv.Itoa(untraced.id)+"/trace", "alice", "")
+	if resp.StatusCode != http.StatusNoContent || !untraced.trace.enabled() {
+		t.Error("failed to turn tracing on", resp.Status)
+	}
+
+	resp = adminRequest(t, srv, "DELETE", "/connections/"+strconv.Itoa(traced.id)+"/trace", "alice", "")
+	if resp.StatusCode != http.StatusNoContent || traced.trace.enabled() {
+		t.Error("failed to turn tracing off", resp.Status)
+	}
+
+	if resp := adminRequest(t, srv, "GET", "/connections/"+strconv.Itoa(traced.id)+"/trace", "alice", ""); resp.StatusCode != http.StatusOK {
+		t.Error("failed to get the trace", resp.Status)
+	}
+}
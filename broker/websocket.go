@@ -0,0 +1,387 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// STOMP over WebSocket, as spoken by browser clients.  Each STOMP frame
+// goes out as one WebSocket message; what comes in is read as a stream,
+// so frames can be split across messages or share one.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// The largest payload a control frame can have.
+const wsMaxControl = 125
+
+// How long a client gets to send the handshake request's headers, so
+// one that connects and says nothing doesn't hold a connection open.
+const wsHandshakeTimeout = 10 * time.Second
+
+var errWSProtocol = errors.New("websocket protocol error")
+
+// wsSubprotocols are the STOMP versions browsers ask for, best first.
+var wsSubprotocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsUpgrade does the opening handshake and takes the connection over
+// from the HTTP server.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errWSProtocol
+	case !headerContains(r.Header, "Connection", "upgrade"), !headerContains(r.Header, "Upgrade", "websocket"), key == "":
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errWSProtocol
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errWSProtocol
+	}
+
+	var protocol string
+	for _, p := range wsSubprotocols {
+		if headerContains(r.Header, "Sec-WebSocket-Protocol", p) {
+			protocol = p
+			break
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't upgrade this connection", http.StatusInternalServerError)
+		return nil, errWSProtocol
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	resp += "\r\n"
+
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newWSConn(conn, rw.Reader), nil
+}
+
+// wsConn is a net.Conn carrying the payload of a WebSocket connection.
+// Reads unmask and join up data frames, and answer pings; each Write
+// is sent as one message.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// What's left of the data frame being read, and its mask.
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	final     bool
+
+	writeLock sync.Mutex
+	closed    bool
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader) *wsConn {
+	ws := &wsConn{}
+	ws.Conn = conn
+	ws.r = r
+	ws.final = true
+
+	return ws
+}
+
+// readHeader reads the next frame's header, returning its opcode.
+func (ws *wsConn) readHeader() (byte, bool, uint64, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(ws.r, hdr[:]); err != nil {
+		return 0, false, 0, err
+	}
+
+	fin := hdr[0]&0x80 != 0
+	opcode := hdr[0] & 0x0f
+
+	// Clients have to mask everything they send, and nothing's been
+	// negotiated that would use the reserved bits.
+	if hdr[0]&0x70 != 0 || hdr[1]&0x80 == 0 {
+		return 0, false, 0, errWSProtocol
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return 0, false, 0, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return 0, false, 0, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if _, err := io.ReadFull(ws.r, ws.mask[:]); err != nil {
+		return 0, false, 0, err
+	}
+	ws.maskPos = 0
+
+	return opcode, fin, length, nil
+}
+
+func (ws *wsConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= ws.mask[ws.maskPos%4]
+		ws.maskPos++
+	}
+}
+
+// control handles a control frame that turned up in the middle of the
+// data.
+func (ws *wsConn) control(opcode byte, length uint64) error {
+	if length > wsMaxControl {
+		return errWSProtocol
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return err
+	}
+	ws.unmask(payload)
+
+	switch opcode {
+	case wsPing:
+		return ws.writeFrame(wsPong, payload)
+	case wsPong:
+		return nil
+	case wsClose:
+		// Echo the status code, if there was one, and hang up.
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		ws.writeFrame(wsClose, payload)
+		return io.EOF
+	}
+
+	return errWSProtocol
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for ws.remaining == 0 {
+		opcode, fin, length, err := ws.readHeader()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsText, wsBinary:
+			if !ws.final {
+				return 0, errWSProtocol
+			}
+		case wsContinuation:
+			if ws.final {
+				return 0, errWSProtocol
+			}
+		default:
+			if !fin {
+				return 0, errWSProtocol
+			}
+			if err := ws.control(opcode, length); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		ws.final = fin
+		ws.remaining = length
+	}
+
+	if uint64(len(p)) > ws.remaining {
+		p = p[:ws.remaining]
+	}
+
+	n, err := ws.r.Read(p)
+	ws.unmask(p[:n])
+	ws.remaining -= uint64(n)
+
+	return n, err
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	if ws.closed {
+		return net.ErrClosed
+	}
+
+	hdr := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+
+	if _, err := ws.Conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+
+	if opcode == wsClose {
+		ws.closed = true
+	}
+
+	return nil
+}
+
+// Write sends p as one message.  Browsers want text, so that's what
+// it's sent as unless it isn't valid UTF-8.
+func (ws *wsConn) Write(p []byte) (int, error) {
+	opcode := byte(wsText)
+	if !utf8.Valid(p) {
+		opcode = wsBinary
+	}
+
+	if err := ws.writeFrame(opcode, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close says goodbye before closing the connection, if the client
+// hasn't already.
+func (ws *wsConn) Close() error {
+	ws.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	ws.writeFrame(wsClose, []byte{0x03, 0xe8})
+
+	return ws.Conn.Close()
+}
+
+// wsListener accepts WebSocket connections through an HTTP server.
+type wsListener struct {
+	ln    net.Listener
+	srv   *http.Server
+	path  string
+	conns chan net.Conn
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newWSListener serves the WebSocket handshake on path, for clients
+// connecting to ln.
+func newWSListener(ln net.Listener, path string) *wsListener {
+	if path == "" {
+		path = "/"
+	}
+
+	wl := &wsListener{}
+	wl.ln = ln
+	wl.path = path
+	wl.conns = make(chan net.Conn)
+	wl.done = make(chan struct{})
+	wl.srv = &http.Server{Handler: wl, ReadHeaderTimeout: wsHandshakeTimeout}
+
+	go wl.srv.Serve(ln)
+
+	return wl
+}
+
+func (wl *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != wl.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	ws, err := wsUpgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	select {
+	case wl.conns <- ws:
+	case <-wl.done:
+		ws.Close()
+	}
+}
+
+func (wl *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops taking new connections.  The ones already handed over
+// belong to whoever accepted them.
+func (wl *wsListener) Close() error {
+	var err error
+	wl.closeOnce.Do(func() {
+		close(wl.done)
+		err = wl.srv.Close()
+	})
+
+	return err
+}
+
+func (wl *wsListener) Addr() net.Addr {
+	return wl.ln.Addr()
+}
@@ -2,64 +2,285 @@ package dest
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Broadcast hands every message to every subscriber.
+//
+// When Retain is set, or a message is sent with a "retain:true"
+// header, the last message is kept and replayed to each new
+// subscriber.  If RetainKey names a header, the last message is kept
+// for every distinct value of that header instead.  Retained messages
+// count towards the destination's usage until they're replaced or
+// purged.
+//
+// When Replay is set, recent messages are kept there so subscribers
+// can catch up with SubscribeFrom.
+//
+// When QueueSize is set, each subscriber gets a queue of that many
+// messages, and Overflow decides what happens when it fills up.
+// BlockTimeout bounds how long BlockProducer will wait; zero waits
+// forever.  Without a queue, subscribers that are out of credit miss
+// messages.  Subscribers joining after these are changed keep the
+// settings they started with.
 type Broadcast struct {
+	Retain       bool
+	RetainKey    string
+	Replay       *ReplayBuffer
+	QueueSize    int
+	Overflow     OverflowPolicy
+	BlockTimeout time.Duration
+
 	subsLock sync.RWMutex
-	subs     []Sub
+	subs     []*subQueue
+
+	retainedLock sync.Mutex
+	retained     map[string]*Message
+
+	usage *Usage
 }
 
+// Subscribe pushes the retained messages to the new subscriber after
+// letting go of subsLock, like Send, since a push can block.  A message
+// sent in the meantime may get there ahead of them.
 func (b *Broadcast) Subscribe(s Sub) error {
 	b.subsLock.Lock()
-	defer b.subsLock.Unlock()
+	q, err := b.addSub(s)
+	var msgs []*Message
+	if err == nil {
+		msgs = b.Retained()
+	}
+	b.subsLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, m := range msgs {
+		q.push(m)
+	}
+
+	return nil
+}
+
+// SubscribeFrom subscribes and then replays everything in the replay
+// buffer from the given point.  If some of that has already been
+// dropped, the subscriber gets a replay-gap notice first.
+func (b *Broadcast) SubscribeFrom(s Sub, from ReplayPoint) error {
+	if b.Replay == nil {
+		return errors.New("replay isn't enabled for this destination")
+	}
+
+	b.subsLock.Lock()
+	q, err := b.addSub(s)
+	var msgs []*Message
+	var gap bool
+	if err == nil {
+		msgs, gap = b.Replay.Since(from)
+	}
+	b.subsLock.Unlock()
 
+	if err != nil {
+		return err
+	}
+
+	if gap {
+		q.push(replayGapNotice())
+	}
+
+	for _, m := range msgs {
+		q.push(m)
+	}
+
+	return nil
+}
+
+// Must be called with subsLock held.
+func (b *Broadcast) addSub(s Sub) (*subQueue, error) {
 	for _, v := range b.subs {
-		if v == s {
-			return errors.New("this subscription has already been created")
+		if v.sub == s {
+			return nil, errors.New("this subscription has already been created")
 		}
 	}
 
-	b.subs = append(b.subs, s)
+	q := newSubQueue(s, b.QueueSize, b.Overflow, b.BlockTimeout, b.usage)
+	b.subs = append(b.subs, q)
 
-	return nil
+	return q, nil
 }
 
 func (b *Broadcast) Unsubscribe(s Sub) error {
 	b.subsLock.Lock()
 	defer b.subsLock.Unlock()
 
-	count := len(b.subs)
-	for i := 0; i < count; i++ {
-		if b.subs[i] == s {
-			b.subs[i], b.subs[count-1] = b.subs[count-1], b.subs[i]
-			count--
+	// Send may be going through the old slice, so it's left alone.
+	subs := make([]*subQueue, 0, len(b.subs))
+	for _, q := range b.subs {
+		if q.sub == s {
+			q.close()
+		} else {
+			subs = append(subs, q)
 		}
 	}
 
-	if count == len(b.subs) {
+	if len(subs) == len(b.subs) {
 		return errors.New("this subscription didn't appear to be subscribed.")
 	}
 
-	b.subs = b.subs[:count:count]
+	b.subs = subs
 
 	return nil
 }
 
+// Send pushes to a snapshot of the subscribers, so a push that blocks
+// waiting on a slow consumer doesn't hold up Subscribe or Unsubscribe.
 func (b *Broadcast) Send(m *Message) error {
 	b.subsLock.RLock()
-	defer b.subsLock.RUnlock()
+	b.retain(m)
+	if b.Replay != nil {
+		b.Replay.Add(m)
+	}
+	subs := b.subs
+	b.subsLock.RUnlock()
 
-	for _, sub := range b.subs {
-		sub.Send(m)
+	for _, q := range subs {
+		q.push(m)
 	}
 
 	return nil
 }
 
+func (b *Broadcast) Usage() *Usage {
+	return b.usage
+}
+
+func (b *Broadcast) Dispatch() {
+	b.subsLock.RLock()
+	defer b.subsLock.RUnlock()
+
+	for _, q := range b.subs {
+		q.wake()
+	}
+}
+
+// Depth is the number of messages queued for subscribers.
+func (b *Broadcast) Depth() int {
+	b.subsLock.RLock()
+	defer b.subsLock.RUnlock()
+
+	n := 0
+	for _, q := range b.subs {
+		n += q.queued()
+	}
+
+	return n
+}
+
+func (b *Broadcast) Subs() []Sub {
+	b.subsLock.RLock()
+	defer b.subsLock.RUnlock()
+
+	subs := make([]Sub, 0, len(b.subs))
+	for _, q := range b.subs {
+		subs = append(subs, q.sub)
+	}
+
+	return subs
+}
+
+// Purge throws away retained messages, the replay buffer, and
+// anything queued for subscribers.
+func (b *Broadcast) Purge() int {
+	b.subsLock.RLock()
+	defer b.subsLock.RUnlock()
+
+	b.retainedLock.Lock()
+	n := len(b.retained)
+	for _, m := range b.retained {
+		b.usage.drop(m)
+	}
+	b.retained = make(map[string]*Message)
+	b.retainedLock.Unlock()
+
+	if b.Replay != nil {
+		n += b.Replay.Clear()
+	}
+
+	for _, q := range b.subs {
+		n += q.purge()
+	}
+
+	return n
+}
+
+// SubStats describes how a subscriber is keeping up.
+type SubStats struct {
+	Sub     Sub
+	Queued  int
+	Dropped uint64
+}
+
+func (b *Broadcast) Stats() []SubStats {
+	b.subsLock.RLock()
+	defer b.subsLock.RUnlock()
+
+	stats := make([]SubStats, 0, len(b.subs))
+	for _, q := range b.subs {
+		stats = append(stats, SubStats{q.sub, q.queued(), atomic.LoadUint64(&q.dropped)})
+	}
+
+	return stats
+}
+
+// Retained returns copies of the retained messages, oldest first,
+// marked for redelivery.
+func (b *Broadcast) Retained() []*Message {
+	b.retainedLock.Lock()
+	defer b.retainedLock.Unlock()
+
+	msgs := make([]*Message, 0, len(b.retained))
+	for _, m := range b.retained {
+		rm := m.copy()
+		rm.Retained = true
+		rm.stats = m.stats
+		rm.enqueued = m.enqueued
+		msgs = append(msgs, rm)
+	}
+
+	sort.Sort(byMessageId(msgs))
+
+	return msgs
+}
+
+func (b *Broadcast) retain(m *Message) {
+	v, _ := m.Frame.Headers.Get("retain")
+	if !b.Retain && v != "true" {
+		return
+	}
+
+	key := ""
+	if b.RetainKey != "" {
+		key, _ = m.Frame.Headers.Get(b.RetainKey)
+	}
+
+	b.retainedLock.Lock()
+	defer b.retainedLock.Unlock()
+
+	b.usage.hold(m)
+	if old, ok := b.retained[key]; ok {
+		b.usage.drop(old)
+	}
+	b.retained[key] = m
+}
+
 func NewBroadcast() *Broadcast {
 	b := &Broadcast{}
-	b.subs = make([]Sub, 0)
+	b.subs = make([]*subQueue, 0)
+	b.retained = make(map[string]*Message)
+	b.usage = newUsage(destManager.usage)
 
 	return b
 }
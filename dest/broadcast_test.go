@@ -99,3 +99,51 @@ func TestSend1(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestRetained1(t *testing.T) {
+	b := NewBroadcast()
+
+	b.Send(testMessage(getNextMessageId(), nil, ""))
+
+	s1 := &RecordingSub{t: t}
+	b.Subscribe(s1)
+	if len(s1.msgs) != 0 {
+		t.Error("nothing should have been retained")
+	}
+
+	m := testMessage(getNextMessageId(), hdr{"retain": "true"}, "")
+	b.Send(m)
+
+	s2 := &RecordingSub{t: t}
+	b.Subscribe(s2)
+	if len(s2.msgs) != 1 || s2.msgs[0].Id != m.Id || !s2.msgs[0].Retained {
+		t.Error("retained message wasn't replayed")
+	}
+
+	if m.Retained {
+		t.Error("the original message shouldn't be marked retained")
+	}
+}
+
+func TestRetainKey(t *testing.T) {
+	b := NewBroadcast()
+	b.Retain = true
+	b.RetainKey = "key"
+
+	b.Send(testMessage(getNextMessageId(), hdr{"key": "a"}, ""))
+	b.Send(testMessage(getNextMessageId(), hdr{"key": "b"}, ""))
+	last := testMessage(getNextMessageId(), hdr{"key": "a"}, "")
+	b.Send(last)
+
+	s := &RecordingSub{t: t}
+	b.Subscribe(s)
+
+	if len(s.msgs) != 2 {
+		t.Error("expected one retained message per key")
+		t.FailNow()
+	}
+
+	if s.msgs[1].Id != last.Id {
+		t.Error("retained messages should be replayed oldest first")
+	}
+}
@@ -0,0 +1,172 @@
+package dest
+
+import (
+	"errors"
+)
+
+type forward struct {
+	to       DestId
+	selector *Selector
+}
+
+// Composite forwards a copy of everything sent to it on to other
+// registered destinations, optionally filtered by a selector.  If it
+// wraps a destination, messages are delivered there as well and
+// subscriptions go to it; otherwise it can't be subscribed to.
+type Composite struct {
+	dest     Dest
+	forwards []forward
+}
+
+// AddForward adds a target.  It has to be called before the composite
+// is registered, so cycles can be caught.
+func (c *Composite) AddForward(to DestId, sel *Selector) {
+	c.forwards = append(c.forwards, forward{to, sel})
+}
+
+func (c *Composite) Subscribe(s Sub) error {
+	if c.dest == nil {
+		return errors.New("this destination only forwards messages")
+	}
+
+	return c.dest.Subscribe(s)
+}
+
+func (c *Composite) Unsubscribe(s Sub) error {
+	if c.dest == nil {
+		return errors.New("this destination only forwards messages")
+	}
+
+	return c.dest.Unsubscribe(s)
+}
+
+func (c *Composite) Send(m *Message) error {
+	var err error
+	if c.dest != nil {
+		err = c.dest.Send(m)
+	}
+
+	for _, f := range c.forwards {
+		if !f.selector.Matches(m) {
+			continue
+		}
+
+		// Each target accounts for its own copy, and has its own
+		// quota and duplicate detection.  The producer has already
+		// been let through, so a target over its high-water mark
+		// still takes the message.
+		fm := m.copy()
+		ok, err := admit(f.to, fm)
+		if err == nil && ok {
+			err = deliver(f.to, fm)
+		}
+
+		if err != nil {
+			log.Warn("failed to forward message", "message", m.Id, "destination", f.to, "err", err)
+		}
+	}
+
+	return err
+}
+
+func (c *Composite) SubscribeFrom(s Sub, from ReplayPoint) error {
+	if r, ok := c.dest.(Replayer); ok {
+		return r.SubscribeFrom(s, from)
+	}
+
+	return errors.New("destination doesn't support replay")
+}
+
+func (c *Composite) Requeue(m *Message) {
+	if r, ok := c.dest.(Requeuer); ok {
+		r.Requeue(m)
+	}
+}
+
+func (c *Composite) Dispatch() {
+	if d, ok := c.dest.(Dispatcher); ok {
+		d.Dispatch()
+	}
+}
+
+func (c *Composite) Subs() []Sub {
+	if l, ok := c.dest.(SubLister); ok {
+		return l.Subs()
+	}
+
+	return nil
+}
+
+func (c *Composite) Purge() int {
+	if p, ok := c.dest.(Purger); ok {
+		return p.Purge()
+	}
+
+	return 0
+}
+
+func (c *Composite) Depth() int {
+	if d, ok := c.dest.(Depther); ok {
+		return d.Depth()
+	}
+
+	return 0
+}
+
+func (c *Composite) Usage() *Usage {
+	if r, ok := c.dest.(UsageReporter); ok {
+		return r.Usage()
+	}
+
+	return nil
+}
+
+func (c *Composite) forwardsTo() []DestId {
+	ids := make([]DestId, 0, len(c.forwards))
+	for _, f := range c.forwards {
+		ids = append(ids, f.to)
+	}
+
+	return ids
+}
+
+func NewComposite(d Dest) *Composite {
+	c := &Composite{}
+	c.dest = d
+	c.forwards = make([]forward, 0)
+
+	return c
+}
+
+// createsCycle reports whether registering d as id would let messages
+// forward around in a circle.
+func createsCycle(id DestId, d Dest) bool {
+	seen := make(map[DestId]bool)
+
+	var visit func(Dest) bool
+	visit = func(d Dest) bool {
+		c, ok := d.(*Composite)
+		if !ok {
+			return false
+		}
+
+		for _, to := range c.forwardsTo() {
+			if to == id {
+				return true
+			}
+
+			if seen[to] {
+				continue
+			}
+			seen[to] = true
+
+			if e, exists := getEntry(to); exists && visit(e.dest) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return visit(d)
+}
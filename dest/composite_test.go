@@ -0,0 +1,122 @@
+package dest
+
+import (
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	sel, err := ParseSelector("type = 'order' AND region <> 'eu' OR urgent = 'true'")
+	if err != nil {
+		t.Error("selector didn't parse", err)
+		t.FailNow()
+	}
+
+	cases := []struct {
+		headers map[string]string
+		match   bool
+	}{
+		{map[string]string{"type": "order", "region": "us"}, true},
+		{map[string]string{"type": "order", "region": "eu"}, false},
+		{map[string]string{"type": "quote"}, false},
+		{map[string]string{"type": "quote", "urgent": "true"}, true},
+	}
+
+	for _, c := range cases {
+		if sel.Matches(testMessage(0, c.headers, "")) != c.match {
+			t.Errorf("selector match was wrong for %v", c.headers)
+		}
+	}
+
+	for _, bad := range []string{"", "type =", "type == 'a'", "type = order", "type = 'a' XOR b = 'c'", "type = 'a"} {
+		if _, err := ParseSelector(bad); err == nil {
+			t.Errorf("selector '%s' should have failed to parse", bad)
+		}
+	}
+}
+
+func TestComposite(t *testing.T) {
+	orders := NewQueue()
+	audit := NewBroadcast()
+	AddDest("test/composite-audit", audit)
+	defer RemoveDest("test/composite-audit")
+
+	c := NewComposite(orders)
+	sel, _ := ParseSelector("type = 'order'")
+	c.AddForward("test/composite-audit", sel)
+
+	if err := AddDest("test/composite-orders", c); err != nil {
+		t.Error("failed to add composite", err)
+		t.FailNow()
+	}
+	defer RemoveDest("test/composite-orders")
+
+	s := &RecordingSub{t: t}
+	Subscribe("test/composite-audit", s)
+
+	Send("test/composite-orders", testMessage(0, hdr{"type": "order"}, "").Frame)
+	Send("test/composite-orders", testMessage(0, hdr{"type": "quote"}, "").Frame)
+
+	if orders.Depth() != 2 {
+		t.Error("every message should go to the wrapped queue")
+	}
+
+	if len(s.msgs) != 1 {
+		t.Error("only matching messages should be forwarded")
+	}
+
+	if err := Subscribe("test/composite-orders", &RecordingSub{t: t}); err != nil {
+		t.Error("subscriptions should go to the wrapped queue")
+	}
+}
+
+func TestCompositeQuota(t *testing.T) {
+	full := NewQueue()
+	full.Usage().SetLimit(1)
+	AddDest("test/composite-full", full)
+	defer RemoveDest("test/composite-full")
+
+	c := NewComposite(NewQueue())
+	c.AddForward("test/composite-full", nil)
+	AddDest("test/composite-source", c)
+	defer RemoveDest("test/composite-source")
+
+	if err := Send("test/composite-source", testMessage(0, hdr{"type": "order"}, "").Frame); err != nil {
+		t.Error("the source should still take the message", err)
+	}
+
+	if full.Depth() != 0 {
+		t.Error("a target over its quota shouldn't get a copy")
+	}
+}
+
+func TestCompositeCycle(t *testing.T) {
+	a := NewComposite(nil)
+	a.AddForward("test/cycle-b", nil)
+	if err := AddDest("test/cycle-a", a); err != nil {
+		t.Error("forwarding to a missing destination is fine", err)
+	}
+	defer RemoveDest("test/cycle-a")
+
+	b := NewComposite(nil)
+	b.AddForward("test/cycle-c", nil)
+	if err := AddDest("test/cycle-b", b); err != nil {
+		t.Error("there's no cycle yet", err)
+	}
+	defer RemoveDest("test/cycle-b")
+
+	c := NewComposite(nil)
+	c.AddForward("test/cycle-a", nil)
+	if err := AddDest("test/cycle-c", c); err == nil {
+		t.Error("this should have created a cycle")
+	}
+
+	self := NewComposite(nil)
+	self.AddForward("test/cycle-self", nil)
+	if err := AddDest("test/cycle-self", self); err == nil {
+		t.Error("a destination can't forward to itself")
+	}
+
+	if err := Subscribe("test/cycle-a", &RecordingSub{t: t}); err == nil {
+		t.Error("forwarding-only destinations can't be subscribed to")
+	}
+}
@@ -0,0 +1,148 @@
+package dest
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+const DefaultDedupHeader = "idempotency-key"
+
+// DefaultDedupCount is how many keys a Deduper keeps when it isn't
+// given any limit, so the window can't grow forever.
+const DefaultDedupCount = 10000
+
+type dedupEntry struct {
+	key string
+	id  uint64
+	at  time.Time
+}
+
+// Deduper remembers the values of a header seen on recent messages, so
+// a producer retrying a SEND doesn't enqueue it twice.  Keys are
+// forgotten once there are more than MaxCount of them or they're older
+// than MaxAge.  A limit of zero isn't enforced, but with neither set,
+// MaxCount is taken to be DefaultDedupCount.
+//
+// XXX - The window should be persisted along with the messages once we
+// have a store.
+type Deduper struct {
+	Header   string
+	MaxCount int
+	MaxAge   time.Duration
+
+	lock  sync.Mutex
+	seen  map[string]*list.Element
+	order *list.List
+}
+
+func (d *Deduper) key(m *Message) string {
+	k, _ := m.Frame.Headers.Get(d.Header)
+	return k
+}
+
+// Seen reports whether the message's key is already in the window.
+// Messages without a key are never duplicates.
+func (d *Deduper) Seen(m *Message) bool {
+	_, seen := d.original(m)
+	return seen
+}
+
+// original returns the id of the message that put this message's key
+// in the window, if it's there.
+func (d *Deduper) original(m *Message) (uint64, bool) {
+	k := d.key(m)
+	if k == "" {
+		return 0, false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.trim()
+	if el, exists := d.seen[k]; exists {
+		return el.Value.(*dedupEntry).id, true
+	}
+
+	return 0, false
+}
+
+// Record adds the message's key to the window.  It returns false if
+// the key was already there.
+func (d *Deduper) Record(m *Message) bool {
+	_, ok := d.record(m)
+	return ok
+}
+
+// record is Record, also returning the id of the message that was
+// already there.
+func (d *Deduper) record(m *Message) (uint64, bool) {
+	k := d.key(m)
+	if k == "" {
+		return 0, true
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.trim()
+	if el, exists := d.seen[k]; exists {
+		return el.Value.(*dedupEntry).id, false
+	}
+
+	d.seen[k] = d.order.PushBack(&dedupEntry{k, m.Id, time.Now()})
+	d.trim()
+
+	return 0, true
+}
+
+// Must be called with the lock held.
+func (d *Deduper) trim() {
+	now := time.Now()
+
+	maxCount := d.MaxCount
+	if maxCount <= 0 && d.MaxAge <= 0 {
+		maxCount = DefaultDedupCount
+	}
+
+	for el := d.order.Front(); el != nil; el = d.order.Front() {
+		e := el.Value.(*dedupEntry)
+
+		over := (maxCount > 0 && d.order.Len() > maxCount) ||
+			(d.MaxAge > 0 && now.Sub(e.at) > d.MaxAge)
+		if !over {
+			break
+		}
+
+		d.order.Remove(el)
+		delete(d.seen, e.key)
+	}
+}
+
+func NewDeduper(header string) *Deduper {
+	d := &Deduper{}
+	d.Header = header
+	d.seen = make(map[string]*list.Element)
+	d.order = list.New()
+
+	return d
+}
+
+// SetDedup turns on duplicate detection for a destination.  Passing
+// nil turns it off.
+func SetDedup(id DestId, d *Deduper) error {
+	destManager.destsLock.Lock()
+	defer destManager.destsLock.Unlock()
+
+	e, exists := getEntry(id)
+	if !exists {
+		return errors.New("destination doesn't exist")
+	}
+
+	ne := *e
+	ne.dedup = d
+	destManager.setEntry(id, &ne)
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package dest
+
+import (
+	"goodyear/frame"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDedupCount(t *testing.T) {
+	d := NewDeduper(DefaultDedupHeader)
+	d.MaxCount = 2
+
+	a := testMessage(0, hdr{DefaultDedupHeader: "a"}, "")
+	b := testMessage(0, hdr{DefaultDedupHeader: "b"}, "")
+	c := testMessage(0, hdr{DefaultDedupHeader: "c"}, "")
+
+	if !d.Record(a) || !d.Record(b) {
+		t.Error("new keys should be recorded")
+	}
+
+	if !d.Seen(a) || d.Record(a) {
+		t.Error("a should be a duplicate")
+	}
+
+	d.Record(c)
+	if d.Seen(a) {
+		t.Error("a should have left the window")
+	}
+
+	if d.Seen(NewMessage(frame.NewFrame())) {
+		t.Error("messages without a key are never duplicates")
+	}
+}
+
+func TestDedupAge(t *testing.T) {
+	d := NewDeduper(DefaultDedupHeader)
+	d.MaxAge = 10 * time.Millisecond
+
+	m := testMessage(0, hdr{DefaultDedupHeader: "a"}, "")
+	d.Record(m)
+	time.Sleep(20 * time.Millisecond)
+
+	if d.Seen(m) {
+		t.Error("a should have aged out of the window")
+	}
+}
+
+func TestDedupDefault(t *testing.T) {
+	d := NewDeduper(DefaultDedupHeader)
+
+	first := testMessage(0, hdr{DefaultDedupHeader: "first"}, "")
+	d.Record(first)
+	for i := 0; i < DefaultDedupCount; i++ {
+		d.Record(testMessage(0, hdr{DefaultDedupHeader: strconv.Itoa(i)}, ""))
+	}
+
+	if d.Seen(first) {
+		t.Error("without limits the window should still be bounded")
+	}
+}
+
+func TestDedupSend(t *testing.T) {
+	id := DestId("test/dedup")
+	q := NewQueue()
+	AddDest(id, q)
+	defer RemoveDest(id)
+
+	if err := SetDedup(id, NewDeduper(DefaultDedupHeader)); err != nil {
+		t.Error("failed to set up dedup", err)
+		t.FailNow()
+	}
+
+	first, _ := SendId(id, testMessage(0, hdr{DefaultDedupHeader: "a"}, "").Frame)
+	dup, err := SendId(id, testMessage(0, hdr{DefaultDedupHeader: "a"}, "").Frame)
+	if err != nil {
+		t.Error("duplicates should be accepted", err)
+	}
+
+	if dup != first {
+		t.Error("a duplicate should get the id of the message it duplicates")
+	}
+	Send(id, testMessage(0, hdr{DefaultDedupHeader: "b"}, "").Frame)
+
+	if q.Depth() != 2 {
+		t.Error("the duplicate shouldn't have been queued")
+	}
+
+	if err := SetDedup("test/dedup-missing", NewDeduper(DefaultDedupHeader)); err == nil {
+		t.Error("missing destinations can't have dedup")
+	}
+}
@@ -2,14 +2,36 @@ package dest
 
 import (
 	"errors"
+	"fmt"
 	"goodyear/frame"
+	"goodyear/logging"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var log = logging.Logger(logging.Dest)
+
 type Sub interface {
 	Send(*Message) error
 }
 
+// FlowSub is implemented by subscriptions that limit how many
+// unacknowledged messages they'll take.  Destinations only hand
+// messages to subscriptions with credit left.
+type FlowSub interface {
+	Sub
+	HasCredit() bool
+}
+
+func hasCredit(s Sub) bool {
+	if fs, ok := s.(FlowSub); ok {
+		return fs.HasCredit()
+	}
+
+	return true
+}
+
 type DestId string
 
 type Dest interface {
@@ -18,43 +40,270 @@ type Dest interface {
 	Send(*Message) error
 }
 
+// Dispatcher is implemented by destinations that hold on to messages
+// while their subscribers are out of credit.
+type Dispatcher interface {
+	Dispatch()
+}
+
+// Requeuer is implemented by destinations that can take back a message
+// a subscriber was given but didn't acknowledge, so it can go to
+// someone else.
+type Requeuer interface {
+	Requeue(*Message)
+}
+
+// Requeue hands a message back to the destination it came from.  It's
+// dropped if the destination doesn't take messages back, or is gone.
+func Requeue(id DestId, m *Message) {
+	if e, exists := getEntry(id); exists {
+		if r, ok := e.dest.(Requeuer); ok {
+			r.Requeue(m)
+		}
+	}
+}
+
+// Owner is implemented by subscriptions that belong to a connection,
+// so they can be checked against destinations that connection owns.
+type Owner interface {
+	OwnerId() int
+}
+
+// lookup finds a destination, creating it if it's one that's made on
+// first use.
+func lookup(id DestId) (*destEntry, bool) {
+	if e, exists := getEntry(id); exists {
+		return e, true
+	}
+
+	return autoCreate(id)
+}
+
 func Subscribe(id DestId, s Sub) error {
-	if dst, exists := destManager.dests[id]; exists {
-		return dst.Subscribe(s)
+	if e, exists := lookup(id); exists {
+		if err := e.checkOwner(s); err != nil {
+			return err
+		}
+
+		return e.dest.Subscribe(s)
+	}
+
+	return nil
+}
+
+// Replayer is implemented by destinations that can replay recent
+// messages to a new subscriber.
+type Replayer interface {
+	SubscribeFrom(Sub, ReplayPoint) error
+}
+
+func SubscribeFrom(id DestId, s Sub, from ReplayPoint) error {
+	if e, exists := lookup(id); exists {
+		if err := e.checkOwner(s); err != nil {
+			return err
+		}
+
+		if r, ok := e.dest.(Replayer); ok {
+			return r.SubscribeFrom(s, from)
+		}
+
+		return errors.New("destination doesn't support replay")
 	}
 
 	return nil
 }
 
 func Unsubscribe(id DestId, s Sub) error {
-	if dst, exists := destManager.dests[id]; exists {
-		return dst.Unsubscribe(s)
+	if e, exists := getEntry(id); exists {
+		return e.dest.Unsubscribe(s)
 	}
 
 	return nil
 }
 
+// Dispatch tells a destination that some of its subscribers may have
+// credit again.
+func Dispatch(id DestId) {
+	if e, exists := getEntry(id); exists {
+		if d, ok := e.dest.(Dispatcher); ok {
+			d.Dispatch()
+		}
+	}
+}
+
+// Send delivers a frame to a destination.  Frames carrying a delay or
+// deliver-at header are held by the scheduler until they're due.
+// Duplicates of recently sent frames are quietly dropped.
 func Send(id DestId, f *frame.Frame) error {
+	_, err := SendId(id, f)
+
+	return err
+}
+
+// SendId is Send, returning the id the message was given.  That's
+// what CancelScheduled takes.  A duplicate gets the id of the message
+// it duplicates.
+func SendId(id DestId, f *frame.Frame) (uint64, error) {
 	m := NewMessage(f)
 	m.Id = getNextMessageId()
 
-	if dst, exists := destManager.dests[id]; exists {
-		return dst.Send(m)
+	at, scheduled, err := deliveryTime(f)
+	if err != nil {
+		return 0, err
+	}
+
+	ok, err := admit(id, m)
+	if err != nil {
+		log.Info("refused message", "destination", id, "err", err)
+		return 0, err
+	}
+
+	if !ok {
+		return m.Id, nil
+	}
+
+	if scheduled && at.After(time.Now()) {
+		destManager.scheduler.schedule(id, m, at)
+		return m.Id, nil
+	}
+
+	return m.Id, deliver(id, m)
+}
+
+// admit runs a message past a destination's duplicate detection and
+// memory quota.  Duplicates are quietly turned away, taking the id of
+// the message they duplicate, but going over the quota is an error.
+func admit(id DestId, m *Message) (bool, error) {
+	var dedup *Deduper
+	if e, exists := lookup(id); exists {
+		dedup = e.dedup
+	}
+
+	if dedup != nil {
+		if orig, seen := dedup.original(m); seen {
+			m.Id = orig
+			return false, nil
+		}
+	}
+
+	if err := usageFor(id).CheckQuota(m.Size()); err != nil {
+		return false, err
+	}
+
+	if dedup != nil {
+		if orig, ok := dedup.record(m); !ok {
+			m.Id = orig
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func deliver(id DestId, m *Message) error {
+	if e, exists := lookup(id); exists {
+		e.stats.enqueued.mark(1)
+		m.stats = e.stats
+		m.enqueued = time.Now()
+
+		return e.dest.Send(m)
 	}
 
 	return nil
 }
 
 func AddDest(id DestId, d Dest) error {
-	if _, exists := destManager.dests[id]; exists {
+	destManager.destsLock.Lock()
+
+	if _, exists := getEntry(id); exists {
+		destManager.destsLock.Unlock()
 		return errors.New("destination already exists")
 	}
 
-	destManager.dests[id] = d
+	if createsCycle(id, d) {
+		destManager.destsLock.Unlock()
+		return errors.New("destination would forward to itself")
+	}
+
+	destManager.setEntry(id, &destEntry{dest: d, stats: newDestStats()})
+	destManager.destsLock.Unlock()
+
+	log.Debug("added destination", "destination", id)
+	notify(Event{DestAdded, id})
+
+	return nil
+}
+
+// SubLister is implemented by destinations that can say who's
+// subscribed to them.
+type SubLister interface {
+	Subs() []Sub
+}
+
+// Purger is implemented by destinations that can throw away the
+// messages they're holding.
+type Purger interface {
+	Purge() int
+}
+
+// RemoveDest deletes a destination.  Anything it was holding is
+// purged, and each of its subscribers is unsubscribed and sent a
+// MESSAGE with a destination-removed header.
+func RemoveDest(id DestId) error {
+	destManager.destsLock.Lock()
+	e, exists := getEntry(id)
+	if exists {
+		destManager.setEntry(id, nil)
+	}
+	destManager.destsLock.Unlock()
+
+	if !exists {
+		return errors.New("destination doesn't exist")
+	}
+
+	log.Debug("removed destination", "destination", id)
+	notify(Event{DestRemoved, id})
+
+	if p, ok := e.dest.(Purger); ok {
+		p.Purge()
+	}
+
+	if l, ok := e.dest.(SubLister); ok {
+		for _, s := range l.Subs() {
+			e.dest.Unsubscribe(s)
+			s.Send(notice("destination-removed", string(id)))
+		}
+	}
 
 	return nil
 }
 
+// Purge throws away the messages a destination is holding, returning
+// how many there were.
+func Purge(id DestId) (int, error) {
+	e, exists := getEntry(id)
+	if !exists {
+		return 0, errors.New("destination doesn't exist")
+	}
+
+	p, ok := e.dest.(Purger)
+	if !ok {
+		return 0, errors.New("destination can't be purged")
+	}
+
+	return p.Purge(), nil
+}
+
+// Shutdown stops delivering scheduled messages, and returns how many
+// were still waiting.  Destinations belong to the process, so this is
+// for when the process is done with them, not when one broker is.
+//
+// XXX - Once we have persistent stores, this is where they get flushed,
+// and scheduled messages would survive instead of being dropped.
+func Shutdown() int {
+	return destManager.scheduler.stop()
+}
+
 func getNextMessageId() uint64 {
 	defer destManager.messageIdLock.Unlock()
 	destManager.messageIdLock.Lock()
@@ -66,15 +315,49 @@ func getNextMessageId() uint64 {
 
 }
 
+// destEntry is a registered destination.  Temporary destinations
+// belong to the connection that created them.  Entries aren't changed
+// once they're registered; they're replaced instead.
+type destEntry struct {
+	dest  Dest
+	temp  bool
+	owner int
+	dedup *Deduper
+	stats *destStats
+}
+
+func (e *destEntry) checkOwner(s Sub) error {
+	if !e.temp {
+		return nil
+	}
+
+	if o, ok := s.(Owner); ok && o.OwnerId() == e.owner {
+		return nil
+	}
+
+	return errors.New("temporary destination belongs to another connection")
+}
+
 type destNamespace struct {
-	dests map[DestId]Dest
+	destsLock     sync.Mutex
+	dests         atomic.Value
+	watchers      *watchers
 	messageIdLock sync.RWMutex
 	nextMessageId uint64
+	scheduler     *messageScheduler
+	tempPrefix    string
+	usage         *Usage
 }
 
+// There's one namespace per process, shared by everything using this
+// package.
 var destManager *destNamespace
 
 func init() {
 	destManager = &destNamespace{}
-	destManager.dests = make(map[DestId]Dest)
+	destManager.dests.Store(make(map[DestId]*destEntry))
+	destManager.watchers = &watchers{fns: make(map[WatchId]func(Event))}
+	destManager.tempPrefix = fmt.Sprintf("%s%x.", RemoteTempQueuePrefix, time.Now().UnixNano())
+	destManager.scheduler = newMessageScheduler()
+	destManager.usage = newUsage(nil)
 }
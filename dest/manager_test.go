@@ -0,0 +1,76 @@
+package dest
+
+import (
+	"testing"
+)
+
+func TestRemoveDest(t *testing.T) {
+	id := DestId("test/remove")
+	q := NewQueue()
+	AddDest(id, q)
+
+	Send(id, testMessage(0, nil, "waiting").Frame)
+
+	s := &CreditSub{RecordingSub{t: t}, 0}
+	Subscribe(id, s)
+
+	if err := RemoveDest(id); err != nil {
+		t.Error("failed to remove destination", err)
+		t.FailNow()
+	}
+
+	if len(q.Subs()) != 0 {
+		t.Error("subscribers should have been unsubscribed")
+	}
+
+	if q.Depth() != 0 || q.Usage().Used() != 0 {
+		t.Error("the queue should have been purged")
+	}
+
+	if len(s.msgs) != 1 {
+		t.Error("the subscriber should have been told")
+		t.FailNow()
+	}
+
+	if v, _ := s.msgs[0].Frame.Headers.Get("destination-removed"); v != string(id) {
+		t.Error("the notice didn't name the destination")
+	}
+
+	if err := RemoveDest(id); err == nil {
+		t.Error("we shouldn't be able to remove it twice")
+	}
+
+	if err := AddDest(id, NewQueue()); err != nil {
+		t.Error("we should be able to add it again", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	id := DestId("test/purge")
+	b := NewBroadcast()
+	b.Retain = true
+	b.Replay = NewReplayBuffer()
+	AddDest(id, b)
+
+	Send(id, testMessage(0, nil, "one").Frame)
+	Send(id, testMessage(0, nil, "two").Frame)
+
+	n, err := Purge(id)
+	if err != nil {
+		t.Error("failed to purge", err)
+	}
+
+	if n != 3 {
+		t.Error("expected one retained and two replayable messages")
+	}
+
+	s := &RecordingSub{t: t}
+	Subscribe(id, s)
+	if len(s.msgs) != 0 {
+		t.Error("nothing should have been retained")
+	}
+
+	if _, err := Purge("test/purge-missing"); err == nil {
+		t.Error("missing destinations can't be purged")
+	}
+}
@@ -2,22 +2,92 @@ package dest
 
 import (
 	"goodyear/frame"
+	"strconv"
+	"time"
 )
 
 type Message struct {
-	Frame *frame.Frame
-	Id uint64
+	Frame    *frame.Frame
+	Id       uint64
+	Priority int
+	Retained bool
+
+	// How many queues are holding on to the message, so its bytes
+	// are only counted once.
+	holds int32
+
+	// The stats of the destination it was sent to, and when.
+	stats    *destStats
+	enqueued time.Time
+}
+
+type byMessageId []*Message
+
+func (s byMessageId) Len() int {
+	return len(s)
+}
+
+func (s byMessageId) Less(i, j int) bool {
+	return s[i].Id < s[j].Id
+}
+
+func (s byMessageId) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Size is the number of bytes held by the message's body and headers.
+func (m *Message) Size() int {
+	n := len(m.Frame.Body)
+	for k, values := range m.Frame.Headers {
+		for _, v := range values {
+			n += len(k) + len(v) + 2
+		}
+	}
+
+	return n
+}
+
+// notice builds an empty message carrying a single goodyear-specific
+// header, for telling a subscriber about something out of band.
+func notice(header, value string) *Message {
+	f := frame.NewFrame()
+	f.Headers.Add(header, value)
+
+	m := NewMessage(f)
+	m.Id = getNextMessageId()
+
+	return m
 }
 
 func Ack(m *Message) {
+	if m.stats != nil {
+		m.stats.acked.Inc()
+	}
 }
 
 func Nack(m *Message) {
+	if m.stats != nil {
+		m.stats.nacked.Inc()
+	}
+}
+
+// copy makes a new message with the same frame and id, for a queue
+// that accounts for it separately.  It's built field by field, since
+// other queues may be changing the original's hold count.
+func (m *Message) copy() *Message {
+	return &Message{Frame: m.Frame, Id: m.Id, Priority: m.Priority, Retained: m.Retained}
 }
 
 func NewMessage(f *frame.Frame) *Message {
 	m := &Message{}
 	m.Frame = f
+	m.Priority = DefaultPriority
+
+	if v, ok := f.Headers.Get("priority"); ok {
+		if p, err := strconv.Atoi(v); err == nil && p >= MinPriority && p <= MaxPriority {
+			m.Priority = p
+		}
+	}
 
 	return m
 }
@@ -0,0 +1,22 @@
+package dest
+
+import (
+	"goodyear/frame"
+)
+
+type hdr map[string]string
+
+// testMessage builds a message with the given id, headers and body.
+// Tests that care about ordering by id can pass getNextMessageId().
+func testMessage(id uint64, headers hdr, body string) *Message {
+	f := frame.NewFrame()
+	for k, v := range headers {
+		f.Headers.Add(k, v)
+	}
+	f.Body = []byte(body)
+
+	m := NewMessage(f)
+	m.Id = id
+
+	return m
+}
@@ -0,0 +1,120 @@
+package dest
+
+import (
+	"container/list"
+)
+
+const (
+	MinPriority     = 0
+	MaxPriority     = 9
+	DefaultPriority = 4
+)
+
+type priorityEntry struct {
+	m        *Message
+	seq      uint64
+	priority int
+}
+
+// PriorityBuffer holds messages waiting for delivery.  Higher
+// priorities come out first, and messages of the same priority come
+// out in the order they went in.
+//
+// If StarvationLimit is non-zero, then after that many pops in a row
+// that jumped ahead of an older message, the oldest waiting message is
+// handed out regardless of its priority.
+type PriorityBuffer struct {
+	StarvationLimit int
+
+	levels  [MaxPriority + 1]*list.List
+	count   int
+	seq     uint64
+	skipped int
+}
+
+func (pb *PriorityBuffer) Len() int {
+	return pb.count
+}
+
+func (pb *PriorityBuffer) Push(m *Message) {
+	p := m.Priority
+	switch {
+	case p < MinPriority:
+		p = MinPriority
+	case p > MaxPriority:
+		p = MaxPriority
+	}
+
+	pb.levels[p].PushBack(&priorityEntry{m, pb.seq, p})
+	pb.seq++
+	pb.count++
+}
+
+func (pb *PriorityBuffer) Pop() *Message {
+	return pb.PopFunc(nil)
+}
+
+// PopFunc is like Pop, but only considers messages that accept says
+// can go now.  Messages it passes over keep their place.
+func (pb *PriorityBuffer) PopFunc(accept func(*Message) bool) *Message {
+	if pb.count == 0 {
+		return nil
+	}
+
+	var highest, oldest *list.Element
+
+	for p := MaxPriority; p >= MinPriority; p-- {
+		l := pb.levels[p]
+
+		// Within a level the first acceptable message is also the
+		// oldest acceptable one.
+		var el *list.Element
+		for el = l.Front(); el != nil; el = el.Next() {
+			if accept == nil || accept(el.Value.(*priorityEntry).m) {
+				break
+			}
+		}
+
+		if el == nil {
+			continue
+		}
+
+		if highest == nil {
+			highest = el
+		}
+
+		if oldest == nil || el.Value.(*priorityEntry).seq < oldest.Value.(*priorityEntry).seq {
+			oldest = el
+		}
+	}
+
+	if highest == nil {
+		return nil
+	}
+
+	from := highest
+	switch {
+	case highest == oldest:
+		pb.skipped = 0
+	case pb.StarvationLimit > 0 && pb.skipped >= pb.StarvationLimit:
+		from = oldest
+		pb.skipped = 0
+	default:
+		pb.skipped++
+	}
+
+	e := from.Value.(*priorityEntry)
+	pb.levels[e.priority].Remove(from)
+	pb.count--
+
+	return e.m
+}
+
+func NewPriorityBuffer() *PriorityBuffer {
+	pb := &PriorityBuffer{}
+	for i := range pb.levels {
+		pb.levels[i] = list.New()
+	}
+
+	return pb
+}
@@ -0,0 +1,220 @@
+package dest
+
+import (
+	"errors"
+	"sync"
+)
+
+// Queue hands each message to exactly one subscriber, round robin.
+// Messages that arrive while nobody is subscribed, or while every
+// subscriber is out of credit, wait in a PriorityBuffer.
+//
+// Messages with a message-group (or JMSXGroupID) header all go to the
+// same subscriber, so they're processed in order.  When that
+// subscriber goes away the group moves to another one.
+type Queue struct {
+	lock    sync.Mutex
+	subs    []Sub
+	next    int
+	pending *PriorityBuffer
+	usage   *Usage
+	groups  map[string]Sub
+}
+
+func messageGroup(m *Message) string {
+	if g, ok := m.Frame.Headers.Get("message-group"); ok {
+		return g
+	}
+
+	g, _ := m.Frame.Headers.Get("JMSXGroupID")
+
+	return g
+}
+
+func (q *Queue) Subscribe(s Sub) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, v := range q.subs {
+		if v == s {
+			return errors.New("this subscription has already been created")
+		}
+	}
+
+	q.subs = append(q.subs, s)
+	q.dispatch()
+
+	return nil
+}
+
+func (q *Queue) Unsubscribe(s Sub) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, v := range q.subs {
+		if v == s {
+			q.subs = append(q.subs[:i], q.subs[i+1:]...)
+
+			for g, gs := range q.groups {
+				if gs == s {
+					delete(q.groups, g)
+				}
+			}
+
+			q.dispatch()
+
+			return nil
+		}
+	}
+
+	return errors.New("this subscription didn't appear to be subscribed.")
+}
+
+func (q *Queue) Send(m *Message) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.pending.Push(m)
+	q.usage.hold(m)
+	q.dispatch()
+
+	return nil
+}
+
+// Requeue puts back a message that a subscriber didn't acknowledge.
+//
+// XXX - It goes to the back of its priority rather than where it was.
+func (q *Queue) Requeue(m *Message) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.pending.Push(m)
+	q.usage.hold(m)
+	q.dispatch()
+}
+
+func (q *Queue) Dispatch() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.dispatch()
+}
+
+// Depth returns the number of messages waiting for a subscriber.
+func (q *Queue) Depth() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.pending.Len()
+}
+
+func (q *Queue) Subs() []Sub {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	subs := make([]Sub, len(q.subs))
+	copy(subs, q.subs)
+
+	return subs
+}
+
+func (q *Queue) Purge() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := 0
+	for m := q.pending.Pop(); m != nil; m = q.pending.Pop() {
+		q.usage.drop(m)
+		n++
+	}
+
+	return n
+}
+
+// Groups returns which subscriber each message group is pinned to.
+func (q *Queue) Groups() map[string]Sub {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	groups := make(map[string]Sub, len(q.groups))
+	for g, s := range q.groups {
+		groups[g] = s
+	}
+
+	return groups
+}
+
+func (q *Queue) Usage() *Usage {
+	return q.usage
+}
+
+func (q *Queue) SetStarvationLimit(n int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.pending.StarvationLimit = n
+}
+
+// Must be called with the lock held.
+func (q *Queue) dispatch() {
+	for q.pending.Len() > 0 {
+		anyCredit := false
+		for _, s := range q.subs {
+			if hasCredit(s) {
+				anyCredit = true
+				break
+			}
+		}
+
+		// Grouped messages have to wait for their own subscriber;
+		// everything else can go to anyone.
+		m := q.pending.PopFunc(func(m *Message) bool {
+			if s, pinned := q.groups[messageGroup(m)]; pinned {
+				return hasCredit(s)
+			}
+
+			return anyCredit
+		})
+
+		if m == nil {
+			return
+		}
+
+		g := messageGroup(m)
+		s, pinned := q.groups[g]
+		if !pinned {
+			s = q.nextSub()
+			if g != "" {
+				q.groups[g] = s
+			}
+		}
+
+		q.usage.drop(m)
+		sendTo(s, m)
+	}
+}
+
+// nextSub picks the next subscriber in turn that has credit.  Must be
+// called with the lock held.
+func (q *Queue) nextSub() Sub {
+	for i := 0; i < len(q.subs); i++ {
+		s := q.subs[q.next%len(q.subs)]
+		q.next++
+
+		if hasCredit(s) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func NewQueue() *Queue {
+	q := &Queue{}
+	q.subs = make([]Sub, 0)
+	q.pending = NewPriorityBuffer()
+	q.usage = newUsage(destManager.usage)
+	q.groups = make(map[string]Sub)
+
+	return q
+}
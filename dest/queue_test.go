@@ -0,0 +1,202 @@
+package dest
+
+import (
+	"testing"
+)
+
+type RecordingSub struct {
+	t    *testing.T
+	msgs []*Message
+}
+
+func (s *RecordingSub) Send(m *Message) error {
+	s.msgs = append(s.msgs, m)
+	return nil
+}
+
+func TestPriorityOrder(t *testing.T) {
+	pb := NewPriorityBuffer()
+
+	pb.Push(testMessage(0, hdr{"priority": "1"}, ""))
+	pb.Push(testMessage(1, hdr{"priority": "9"}, ""))
+	pb.Push(testMessage(2, hdr{"priority": "1"}, ""))
+	pb.Push(testMessage(3, hdr{"priority": "9"}, ""))
+	pb.Push(testMessage(4, hdr{"priority": "4"}, ""))
+
+	expected := []uint64{1, 3, 4, 0, 2}
+	for _, id := range expected {
+		if m := pb.Pop(); m == nil || m.Id != id {
+			t.Errorf("expected message %d", id)
+		}
+	}
+
+	if pb.Pop() != nil {
+		t.Error("buffer should be empty")
+	}
+}
+
+func TestPriorityStarvation(t *testing.T) {
+	pb := NewPriorityBuffer()
+	pb.StarvationLimit = 2
+
+	pb.Push(testMessage(0, hdr{"priority": "0"}, ""))
+	for i := uint64(1); i <= 4; i++ {
+		pb.Push(testMessage(i, hdr{"priority": "9"}, ""))
+	}
+
+	expected := []uint64{1, 2, 0, 3, 4}
+	for _, id := range expected {
+		if m := pb.Pop(); m == nil || m.Id != id {
+			t.Errorf("expected message %d", id)
+		}
+	}
+}
+
+func TestQueueBuffersByPriority(t *testing.T) {
+	q := NewQueue()
+
+	q.Send(testMessage(0, hdr{"priority": "0"}, ""))
+	q.Send(testMessage(1, hdr{"priority": "7"}, ""))
+	q.Send(testMessage(2, hdr{"priority": "4"}, ""))
+
+	if q.Depth() != 3 {
+		t.Error("messages should have been buffered")
+	}
+
+	s := &RecordingSub{t: t}
+	if err := q.Subscribe(s); err != nil {
+		t.Error("failed to subscribe")
+		t.FailNow()
+	}
+
+	if len(s.msgs) != 3 || s.msgs[0].Id != 1 || s.msgs[1].Id != 2 || s.msgs[2].Id != 0 {
+		t.Error("messages weren't delivered in priority order")
+	}
+
+	if q.Depth() != 0 {
+		t.Error("queue should be empty")
+	}
+}
+
+func TestQueueRoundRobin(t *testing.T) {
+	q := NewQueue()
+
+	s1 := &RecordingSub{t: t}
+	s2 := &RecordingSub{t: t}
+	q.Subscribe(s1)
+	q.Subscribe(s2)
+
+	for i := uint64(0); i < 4; i++ {
+		q.Send(testMessage(i, nil, ""))
+	}
+
+	if len(s1.msgs) != 2 || len(s2.msgs) != 2 {
+		t.Error("messages weren't spread across subscribers")
+	}
+
+	if err := q.Unsubscribe(s1); err != nil {
+		t.Error("failed to unsubscribe")
+	}
+
+	if err := q.Unsubscribe(s1); err == nil {
+		t.Error("we should have failed to unsubscribe")
+	}
+}
+
+type CreditSub struct {
+	RecordingSub
+	credit int
+}
+
+func (s *CreditSub) HasCredit() bool {
+	return len(s.msgs) < s.credit
+}
+
+func TestQueueCredit(t *testing.T) {
+	q := NewQueue()
+
+	s1 := &CreditSub{RecordingSub{t: t}, 1}
+	s2 := &CreditSub{RecordingSub{t: t}, 2}
+	q.Subscribe(s1)
+	q.Subscribe(s2)
+
+	for i := uint64(0); i < 5; i++ {
+		q.Send(testMessage(i, nil, ""))
+	}
+
+	if len(s1.msgs) != 1 || len(s2.msgs) != 2 {
+		t.Error("subscribers were sent more than their credit")
+	}
+
+	if q.Depth() != 2 {
+		t.Error("messages beyond the credit should have been held")
+	}
+
+	s1.credit = 3
+	q.Dispatch()
+
+	if len(s1.msgs) != 3 || q.Depth() != 0 {
+		t.Error("held messages weren't dispatched once credit came back")
+	}
+}
+
+func TestQueueRequeue(t *testing.T) {
+	q := NewQueue()
+
+	s1 := &RecordingSub{t: t}
+	q.Subscribe(s1)
+	q.Send(testMessage(0, nil, ""))
+	q.Unsubscribe(s1)
+
+	q.Requeue(s1.msgs[0])
+	if q.Depth() != 1 {
+		t.Error("the message should be waiting again")
+	}
+
+	s2 := &RecordingSub{t: t}
+	q.Subscribe(s2)
+	if len(s2.msgs) != 1 || s2.msgs[0].Id != 0 {
+		t.Error("the message should have gone to the next subscriber")
+	}
+}
+
+func TestQueueGroups(t *testing.T) {
+	q := NewQueue()
+
+	s1 := &CreditSub{RecordingSub{t: t}, 10}
+	s2 := &CreditSub{RecordingSub{t: t}, 10}
+	q.Subscribe(s1)
+	q.Subscribe(s2)
+
+	q.Send(testMessage(0, hdr{"message-group": "a"}, ""))
+	q.Send(testMessage(1, hdr{"message-group": "b"}, ""))
+	q.Send(testMessage(2, hdr{"message-group": "a"}, ""))
+	q.Send(testMessage(3, hdr{"message-group": "a"}, ""))
+
+	if len(s1.msgs) != 3 || len(s2.msgs) != 1 {
+		t.Error("group a should have stuck to one subscriber")
+	}
+
+	groups := q.Groups()
+	if groups["a"] != s1 || groups["b"] != s2 {
+		t.Error("group assignments are wrong")
+	}
+
+	// A pinned subscriber that's out of credit holds up its group,
+	// but not anyone else.
+	s1.credit = 3
+	q.Send(testMessage(4, hdr{"message-group": "a"}, ""))
+	q.Send(testMessage(5, hdr{"message-group": "b"}, ""))
+	if q.Depth() != 1 || len(s2.msgs) != 2 {
+		t.Error("only group a should be waiting")
+	}
+
+	q.Unsubscribe(s1)
+	if len(s2.msgs) != 3 || s2.msgs[2].Id != 4 {
+		t.Error("group a should have moved to the remaining subscriber")
+	}
+
+	if q.Groups()["a"] != s2 {
+		t.Error("group a wasn't reassigned")
+	}
+}
@@ -0,0 +1,122 @@
+package dest
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The registry is copy-on-write: the map in destNamespace.dests is
+// never modified once it's stored, so lookups on the hot path don't
+// take any locks.  Changes are made to a copy, under destsLock, and
+// then swapped in.
+
+type EventType int
+
+const (
+	DestAdded EventType = iota
+	DestRemoved
+)
+
+type Event struct {
+	Type EventType
+	Id   DestId
+}
+
+type WatchId int
+
+type watchers struct {
+	lock sync.Mutex
+	next WatchId
+	fns  map[WatchId]func(Event)
+}
+
+func (ns *destNamespace) entries() map[DestId]*destEntry {
+	return ns.dests.Load().(map[DestId]*destEntry)
+}
+
+// setEntry replaces the entry for a destination, or removes it if e is
+// nil.  Must be called with destsLock held.
+func (ns *destNamespace) setEntry(id DestId, e *destEntry) {
+	old := ns.entries()
+	m := make(map[DestId]*destEntry, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+
+	if e == nil {
+		delete(m, id)
+	} else {
+		m[id] = e
+	}
+
+	ns.dests.Store(m)
+}
+
+func getEntry(id DestId) (*destEntry, bool) {
+	e, exists := destManager.entries()[id]
+	return e, exists
+}
+
+// Lookup finds a registered destination.
+func Lookup(id DestId) (Dest, bool) {
+	if e, exists := getEntry(id); exists {
+		return e.dest, true
+	}
+
+	return nil, false
+}
+
+// List returns the ids of the registered destinations starting with
+// prefix, in order.
+func List(prefix string) []DestId {
+	ids := make([]DestId, 0)
+	for id := range destManager.entries() {
+		if strings.HasPrefix(string(id), prefix) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// Watch calls fn whenever a destination is added or removed.  fn is
+// called after the change is made, from whichever goroutine made it,
+// so it shouldn't block.
+func Watch(fn func(Event)) WatchId {
+	w := destManager.watchers
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	id := w.next
+	w.next++
+	w.fns[id] = fn
+
+	return id
+}
+
+func Unwatch(id WatchId) {
+	w := destManager.watchers
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	delete(w.fns, id)
+}
+
+func notify(ev Event) {
+	w := destManager.watchers
+	w.lock.Lock()
+	fns := make([]func(Event), 0, len(w.fns))
+	for _, fn := range w.fns {
+		fns = append(fns, fn)
+	}
+	w.lock.Unlock()
+
+	for _, fn := range fns {
+		fn(ev)
+	}
+}
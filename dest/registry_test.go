@@ -0,0 +1,50 @@
+package dest
+
+import (
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	var events []Event
+	w := Watch(func(ev Event) {
+		events = append(events, ev)
+	})
+
+	AddDest("test/registry/b", NewQueue())
+	AddDest("test/registry/a", NewBroadcast())
+	AddDest("test/registry/a", NewBroadcast())
+
+	if d, ok := Lookup("test/registry/a"); !ok || d == nil {
+		t.Error("lookup failed")
+	}
+
+	if _, ok := Lookup("test/registry/missing"); ok {
+		t.Error("lookup found something that isn't there")
+	}
+
+	ids := List("test/registry/")
+	if len(ids) != 2 || ids[0] != "test/registry/a" || ids[1] != "test/registry/b" {
+		t.Error("list returned the wrong destinations", ids)
+	}
+
+	RemoveDest("test/registry/b")
+	Unwatch(w)
+	RemoveDest("test/registry/a")
+
+	expected := []Event{
+		{DestAdded, "test/registry/b"},
+		{DestAdded, "test/registry/a"},
+		{DestRemoved, "test/registry/b"},
+	}
+
+	if len(events) != len(expected) {
+		t.Error("wrong number of events", events)
+		t.FailNow()
+	}
+
+	for i, ev := range expected {
+		if events[i] != ev {
+			t.Errorf("expected event %v, got %v", ev, events[i])
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package dest
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ReplayPoint says where a subscriber wants to start catching up
+// from.  Messages with an id of at least MessageId, or sent no earlier
+// than Time, are replayed.
+type ReplayPoint struct {
+	MessageId    uint64
+	HasMessageId bool
+	Time         time.Time
+}
+
+type replayEntry struct {
+	m    *Message
+	at   time.Time
+	size int
+}
+
+// ReplayBuffer keeps the most recent messages sent to a destination,
+// bounded by count, bytes and age.  Any limit left at zero isn't
+// enforced.
+type ReplayBuffer struct {
+	MaxCount int
+	MaxBytes int
+	MaxAge   time.Duration
+
+	lock    sync.Mutex
+	entries *list.List
+	bytes   int
+
+	evicted     bool
+	evictedId   uint64
+	evictedTime time.Time
+}
+
+func (rb *ReplayBuffer) Add(m *Message) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	e := &replayEntry{m, time.Now(), m.Size()}
+	rb.entries.PushBack(e)
+	rb.bytes += e.size
+
+	rb.trim()
+}
+
+func (rb *ReplayBuffer) Len() int {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	rb.trim()
+
+	return rb.entries.Len()
+}
+
+// Clear empties the buffer, returning how many messages it held.
+// Anything asked for from before now is reported as a gap.
+func (rb *ReplayBuffer) Clear() int {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	n := rb.entries.Len()
+	if el := rb.entries.Back(); el != nil {
+		e := el.Value.(*replayEntry)
+		rb.evicted = true
+		rb.evictedId = e.m.Id
+		rb.evictedTime = e.at
+	}
+
+	rb.entries.Init()
+	rb.bytes = 0
+
+	return n
+}
+
+// Since returns the buffered messages at or after the replay point.
+// gap is true when messages that would have matched have already
+// been dropped from the buffer.
+func (rb *ReplayBuffer) Since(from ReplayPoint) (msgs []*Message, gap bool) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	rb.trim()
+
+	if rb.evicted {
+		if from.HasMessageId {
+			gap = rb.evictedId >= from.MessageId
+		} else {
+			gap = !rb.evictedTime.Before(from.Time)
+		}
+	}
+
+	for el := rb.entries.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*replayEntry)
+
+		if from.HasMessageId && e.m.Id < from.MessageId {
+			continue
+		}
+
+		if !from.HasMessageId && e.at.Before(from.Time) {
+			continue
+		}
+
+		msgs = append(msgs, e.m)
+	}
+
+	return
+}
+
+// Must be called with the lock held.
+func (rb *ReplayBuffer) trim() {
+	now := time.Now()
+
+	for el := rb.entries.Front(); el != nil; el = rb.entries.Front() {
+		e := el.Value.(*replayEntry)
+
+		over := (rb.MaxCount > 0 && rb.entries.Len() > rb.MaxCount) ||
+			(rb.MaxBytes > 0 && rb.bytes > rb.MaxBytes) ||
+			(rb.MaxAge > 0 && now.Sub(e.at) > rb.MaxAge)
+		if !over {
+			break
+		}
+
+		rb.entries.Remove(el)
+		rb.bytes -= e.size
+
+		rb.evicted = true
+		rb.evictedId = e.m.Id
+		rb.evictedTime = e.at
+	}
+}
+
+func NewReplayBuffer() *ReplayBuffer {
+	rb := &ReplayBuffer{}
+	rb.entries = list.New()
+
+	return rb
+}
+
+// replayGapNotice tells a subscriber that part of what it asked to
+// replay is no longer available.
+func replayGapNotice() *Message {
+	return notice("replay-gap", "true")
+}
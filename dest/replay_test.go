@@ -0,0 +1,109 @@
+package dest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCount(t *testing.T) {
+	rb := NewReplayBuffer()
+	rb.MaxCount = 2
+
+	m1 := testMessage(getNextMessageId(), nil, "one")
+	m2 := testMessage(getNextMessageId(), nil, "two")
+	m3 := testMessage(getNextMessageId(), nil, "three")
+	rb.Add(m1)
+	rb.Add(m2)
+	rb.Add(m3)
+
+	msgs, gap := rb.Since(ReplayPoint{MessageId: m2.Id, HasMessageId: true})
+	if gap {
+		t.Error("there shouldn't be a gap")
+	}
+
+	if len(msgs) != 2 || msgs[0] != m2 || msgs[1] != m3 {
+		t.Error("we didn't replay the right messages")
+	}
+
+	msgs, gap = rb.Since(ReplayPoint{MessageId: m1.Id, HasMessageId: true})
+	if !gap {
+		t.Error("the first message was evicted, there should be a gap")
+	}
+
+	if len(msgs) != 2 {
+		t.Error("we should still replay what we have")
+	}
+}
+
+func TestReplayBytes(t *testing.T) {
+	rb := NewReplayBuffer()
+	rb.MaxBytes = 10
+
+	rb.Add(testMessage(getNextMessageId(), nil, "0123456789"))
+	rb.Add(testMessage(getNextMessageId(), nil, "abc"))
+
+	if rb.Len() != 1 {
+		t.Error("byte limit wasn't enforced")
+	}
+}
+
+func TestReplayTime(t *testing.T) {
+	rb := NewReplayBuffer()
+	rb.MaxAge = 20 * time.Millisecond
+
+	rb.Add(testMessage(getNextMessageId(), nil, "old"))
+	time.Sleep(30 * time.Millisecond)
+
+	start := time.Now()
+	m := testMessage(getNextMessageId(), nil, "new")
+	rb.Add(m)
+
+	msgs, gap := rb.Since(ReplayPoint{Time: start})
+	if gap {
+		t.Error("the evicted message was older than the replay point")
+	}
+
+	if len(msgs) != 1 || msgs[0] != m {
+		t.Error("we didn't replay the right messages")
+	}
+
+	_, gap = rb.Since(ReplayPoint{Time: start.Add(-time.Minute)})
+	if !gap {
+		t.Error("the old message was evicted, there should be a gap")
+	}
+}
+
+func TestBroadcastSubscribeFrom(t *testing.T) {
+	b := NewBroadcast()
+
+	if err := b.SubscribeFrom(&RecordingSub{t: t}, ReplayPoint{}); err == nil {
+		t.Error("replay shouldn't work without a buffer")
+	}
+
+	b.Replay = NewReplayBuffer()
+	b.Replay.MaxCount = 1
+
+	m1 := testMessage(getNextMessageId(), nil, "one")
+	m2 := testMessage(getNextMessageId(), nil, "two")
+	b.Send(m1)
+	b.Send(m2)
+
+	s := &RecordingSub{t: t}
+	if err := b.SubscribeFrom(s, ReplayPoint{MessageId: m1.Id, HasMessageId: true}); err != nil {
+		t.Error("failed to subscribe", err)
+		t.FailNow()
+	}
+
+	if len(s.msgs) != 2 {
+		t.Error("expected a gap notice and one message")
+		t.FailNow()
+	}
+
+	if v, _ := s.msgs[0].Frame.Headers.Get("replay-gap"); v != "true" {
+		t.Error("the first message should have been a gap notice")
+	}
+
+	if s.msgs[1] != m2 {
+		t.Error("we didn't replay the buffered message")
+	}
+}
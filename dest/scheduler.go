@@ -0,0 +1,238 @@
+package dest
+
+import (
+	"container/heap"
+	"errors"
+	"goodyear/frame"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type scheduledMessage struct {
+	dest  DestId
+	m     *Message
+	at    time.Time
+	index int
+}
+
+type scheduleHeap []*scheduledMessage
+
+func (h scheduleHeap) Len() int {
+	return len(h)
+}
+
+func (h scheduleHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].m.Id < h[j].m.Id
+	}
+
+	return h[i].at.Before(h[j].at)
+}
+
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x interface{}) {
+	sm := x.(*scheduledMessage)
+	sm.index = len(*h)
+	*h = append(*h, sm)
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	sm := old[n-1]
+	old[n-1] = nil
+	sm.index = -1
+	*h = old[:n-1]
+
+	return sm
+}
+
+// messageScheduler holds messages sent with a delay or deliver-at
+// header until they're due, then hands them to their destination.
+//
+// XXX - Scheduled messages should be persisted once we have a store.
+type messageScheduler struct {
+	lock    sync.Mutex
+	pending scheduleHeap
+	byId    map[uint64]*scheduledMessage
+	timer   *time.Timer
+	stopped bool
+}
+
+func (s *messageScheduler) schedule(id DestId, m *Message, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sm := &scheduledMessage{dest: id, m: m, at: at}
+	heap.Push(&s.pending, sm)
+	s.byId[m.Id] = sm
+	destManager.usage.hold(m)
+
+	s.resetTimer()
+}
+
+func (s *messageScheduler) cancel(msgId uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sm, exists := s.byId[msgId]
+	if !exists {
+		return false
+	}
+
+	heap.Remove(&s.pending, sm.index)
+	delete(s.byId, msgId)
+	destManager.usage.drop(sm.m)
+	s.resetTimer()
+
+	return true
+}
+
+func (s *messageScheduler) list() []ScheduledInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	infos := make([]ScheduledInfo, 0, len(s.pending))
+	for _, sm := range s.pending {
+		infos = append(infos, ScheduledInfo{sm.m.Id, sm.dest, sm.at})
+	}
+
+	// Sorting the heap itself would move the entries' indexes.
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].At.Equal(infos[j].At) {
+			return infos[i].Id < infos[j].Id
+		}
+
+		return infos[i].At.Before(infos[j].At)
+	})
+
+	return infos
+}
+
+func (s *messageScheduler) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.pending)
+}
+
+func (s *messageScheduler) release() {
+	var due []*scheduledMessage
+
+	s.lock.Lock()
+	now := time.Now()
+	for len(s.pending) > 0 && !s.pending[0].at.After(now) {
+		sm := heap.Pop(&s.pending).(*scheduledMessage)
+		delete(s.byId, sm.m.Id)
+		due = append(due, sm)
+	}
+	s.resetTimer()
+	s.lock.Unlock()
+
+	for _, sm := range due {
+		destManager.usage.drop(sm.m)
+		deliver(sm.dest, sm.m)
+	}
+}
+
+// stop keeps anything else from being released, and returns the
+// number of messages that were still waiting.
+func (s *messageScheduler) stop() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopped = true
+	s.resetTimer()
+
+	return len(s.pending)
+}
+
+// Must be called with the lock held.
+func (s *messageScheduler) resetTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	if s.stopped || len(s.pending) == 0 {
+		return
+	}
+
+	s.timer = time.AfterFunc(s.pending[0].at.Sub(time.Now()), s.release)
+}
+
+func newMessageScheduler() *messageScheduler {
+	s := &messageScheduler{}
+	s.pending = make(scheduleHeap, 0)
+	s.byId = make(map[uint64]*scheduledMessage)
+
+	return s
+}
+
+// The most milliseconds a delay or deliver-at header can hold before
+// they overflow a time.Duration.
+const maxScheduleMillis = math.MaxInt64 / int64(time.Millisecond)
+
+// deliveryTime works out when a frame should be delivered from its
+// delay (milliseconds) and deliver-at (milliseconds since the epoch)
+// headers.  If both are present, the later of the two wins.
+func deliveryTime(f *frame.Frame) (at time.Time, scheduled bool, err error) {
+	if v, ok := f.Headers.Get("delay"); ok {
+		var ms int64
+		if ms, err = strconv.ParseInt(v, 10, 64); err != nil || ms < 0 || ms > maxScheduleMillis {
+			return at, false, errors.New("invalid delay header")
+		}
+
+		at = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		scheduled = true
+	}
+
+	if v, ok := f.Headers.Get("deliver-at"); ok {
+		var ms int64
+		if ms, err = strconv.ParseInt(v, 10, 64); err != nil || ms < 0 || ms > maxScheduleMillis {
+			return at, false, errors.New("invalid deliver-at header")
+		}
+
+		t := time.Unix(0, ms*int64(time.Millisecond))
+		if !scheduled || t.After(at) {
+			at = t
+		}
+		scheduled = true
+	}
+
+	return at, scheduled, nil
+}
+
+// CancelScheduled drops a delayed message before it's delivered.
+func CancelScheduled(msgId uint64) error {
+	if !destManager.scheduler.cancel(msgId) {
+		return errors.New("no scheduled message with that id")
+	}
+
+	return nil
+}
+
+// ScheduledInfo describes a message waiting on a delay.
+type ScheduledInfo struct {
+	Id   uint64    `json:"id"`
+	Dest DestId    `json:"destination"`
+	At   time.Time `json:"at"`
+}
+
+// Scheduled lists the messages waiting on a delay, soonest first.
+func Scheduled() []ScheduledInfo {
+	return destManager.scheduler.list()
+}
+
+// ScheduledCount returns the number of messages waiting on a delay.
+func ScheduledCount() int {
+	return destManager.scheduler.count()
+}
@@ -0,0 +1,134 @@
+package dest
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+type ChanSub struct {
+	msgs chan *Message
+}
+
+func (s *ChanSub) Send(m *Message) error {
+	s.msgs <- m
+	return nil
+}
+
+func newChanSub() *ChanSub {
+	return &ChanSub{make(chan *Message, 16)}
+}
+
+func TestScheduleDelay(t *testing.T) {
+	id := DestId("test/scheduled-delay")
+	AddDest(id, NewBroadcast())
+
+	s := newChanSub()
+	Subscribe(id, s)
+
+	start := time.Now()
+	if err := Send(id, testMessage(0, hdr{"delay": "50"}, "").Frame); err != nil {
+		t.Error("failed to send", err)
+		t.FailNow()
+	}
+
+	select {
+	case <-s.msgs:
+		if time.Since(start) < 50*time.Millisecond {
+			t.Error("message was delivered early")
+		}
+	case <-time.After(time.Second):
+		t.Error("scheduled message was never delivered")
+	}
+}
+
+func TestScheduleDeliverAt(t *testing.T) {
+	id := DestId("test/scheduled-deliver-at")
+	AddDest(id, NewBroadcast())
+
+	s := newChanSub()
+	Subscribe(id, s)
+
+	at := time.Now().Add(30*time.Millisecond).UnixNano() / int64(time.Millisecond)
+	Send(id, testMessage(0, hdr{"deliver-at": strconv.FormatInt(at, 10)}, "").Frame)
+
+	select {
+	case <-s.msgs:
+	case <-time.After(time.Second):
+		t.Error("scheduled message was never delivered")
+	}
+}
+
+func TestScheduleCancel(t *testing.T) {
+	id := DestId("test/scheduled-cancel")
+	AddDest(id, NewBroadcast())
+
+	s := newChanSub()
+	Subscribe(id, s)
+
+	before := ScheduledCount()
+	msgId, err := SendId(id, testMessage(0, hdr{"delay": "50"}, "").Frame)
+	if err != nil || ScheduledCount() != before+1 {
+		t.Error("message wasn't scheduled", err)
+		t.FailNow()
+	}
+
+	found := false
+	for _, si := range Scheduled() {
+		found = found || (si.Id == msgId && si.Dest == id)
+	}
+
+	if !found {
+		t.Error("the scheduled message should be listed")
+	}
+
+	if err := CancelScheduled(msgId); err != nil {
+		t.Error("failed to cancel", err)
+	}
+
+	if err := CancelScheduled(msgId); err == nil {
+		t.Error("we shouldn't be able to cancel twice")
+	}
+
+	select {
+	case <-s.msgs:
+		t.Error("cancelled message was delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestScheduleBadHeader(t *testing.T) {
+	if err := Send("test/scheduled-bad", testMessage(0, hdr{"delay": "soon"}, "").Frame); err == nil {
+		t.Error("bogus delay should have failed")
+	}
+
+	for _, h := range []string{"delay", "deliver-at"} {
+		if err := Send("test/scheduled-bad", testMessage(0, hdr{h: "9223372036854775807"}, "").Frame); err == nil {
+			t.Errorf("%s too far in the future should have failed", h)
+		}
+	}
+}
+
+func TestScheduleStop(t *testing.T) {
+	id := DestId("test/scheduled-stop")
+	AddDest(id, NewBroadcast())
+
+	s := newChanSub()
+	Subscribe(id, s)
+
+	sched := newMessageScheduler()
+	m := testMessage(0, hdr{"delay": "20"}, "")
+	sched.schedule(id, m, time.Now().Add(20*time.Millisecond))
+
+	if n := sched.stop(); n != 1 {
+		t.Error("stop should report the waiting message, got", n)
+	}
+
+	select {
+	case <-s.msgs:
+		t.Error("a stopped scheduler delivered a message")
+	case <-time.After(60 * time.Millisecond):
+	}
+
+	destManager.usage.drop(m)
+}
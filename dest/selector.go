@@ -0,0 +1,140 @@
+package dest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type selectorTerm struct {
+	header string
+	value  string
+	equal  bool
+}
+
+// Selector is a small subset of JMS message selectors: header
+// comparisons like "type = 'order'" or "region <> 'eu'", joined with
+// AND and OR.  AND binds tighter than OR.
+type Selector struct {
+	// Any of these groups matching is a match; every term in a group
+	// has to match for the group to.
+	groups [][]selectorTerm
+}
+
+func (sel *Selector) Matches(m *Message) bool {
+	if sel == nil {
+		return true
+	}
+
+	for _, group := range sel.groups {
+		matched := true
+		for _, term := range group {
+			v, _ := m.Frame.Headers.Get(term.header)
+			if (v == term.value) != term.equal {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func selectorTokens(s string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated string in selector")
+			}
+
+			tokens = append(tokens, s[i:i+end+2])
+			i += end + 2
+
+		case c == '=':
+			tokens = append(tokens, "=")
+			i++
+
+		case strings.HasPrefix(s[i:], "<>"):
+			tokens = append(tokens, "<>")
+			i += 2
+
+		default:
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || strings.IndexByte("-_.", s[j]) >= 0) {
+				j++
+			}
+
+			if j == i {
+				return nil, fmt.Errorf("unexpected '%c' in selector", c)
+			}
+
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+func ParseSelector(s string) (*Selector, error) {
+	tokens, err := selectorTokens(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("empty selector")
+	}
+
+	sel := &Selector{}
+	group := []selectorTerm{}
+
+	for i := 0; ; {
+		if i+3 > len(tokens) {
+			return nil, errors.New("incomplete comparison in selector")
+		}
+
+		header, op, value := tokens[i], tokens[i+1], tokens[i+2]
+		if op != "=" && op != "<>" {
+			return nil, fmt.Errorf("unknown operator '%s' in selector", op)
+		}
+
+		if len(value) < 2 || value[0] != '\'' {
+			return nil, fmt.Errorf("expected a quoted value, got '%s'", value)
+		}
+
+		group = append(group, selectorTerm{header, value[1 : len(value)-1], op == "="})
+		i += 3
+
+		if i == len(tokens) {
+			break
+		}
+
+		switch strings.ToUpper(tokens[i]) {
+		case "AND":
+		case "OR":
+			sel.groups = append(sel.groups, group)
+			group = []selectorTerm{}
+		default:
+			return nil, fmt.Errorf("expected AND or OR, got '%s'", tokens[i])
+		}
+		i++
+	}
+
+	sel.groups = append(sel.groups, group)
+
+	return sel, nil
+}
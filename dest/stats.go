@@ -0,0 +1,169 @@
+package dest
+
+import (
+	"errors"
+	"goodyear/metrics"
+	"sync"
+	"time"
+)
+
+// meter counts events, and keeps enough history to give a rate over
+// the last minute.
+type meter struct {
+	lock    sync.Mutex
+	count   uint64
+	buckets [60]uint64
+	seconds [60]int64
+}
+
+func (m *meter) mark(n uint64) {
+	now := time.Now().Unix()
+	i := now % int64(len(m.buckets))
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.seconds[i] != now {
+		m.seconds[i] = now
+		m.buckets[i] = 0
+	}
+
+	m.buckets[i] += n
+	m.count += n
+}
+
+func (m *meter) total() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.count
+}
+
+// rate is the average number of events per second over the last
+// minute.
+func (m *meter) rate() float64 {
+	now := time.Now().Unix()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var n uint64
+	for i, s := range m.seconds {
+		if now-s < int64(len(m.buckets)) {
+			n += m.buckets[i]
+		}
+	}
+
+	return float64(n) / float64(len(m.buckets))
+}
+
+// destStats are shared by every version of a destEntry, since entries
+// are replaced rather than changed.
+//
+// XXX - Messages don't expire yet.  Once they do, count them here.
+type destStats struct {
+	enqueued  meter
+	delivered metrics.Counter
+	acked     metrics.Counter
+	nacked    metrics.Counter
+	latency   *metrics.Histogram
+}
+
+func newDestStats() *destStats {
+	s := &destStats{}
+	s.latency = metrics.NewHistogram(metrics.LatencyBuckets)
+
+	return s
+}
+
+// sendTo hands a message to a subscriber, counting the delivery and
+// how long the message waited for it.  Retained messages are left out
+// of the wait, since they're meant to stick around.
+func sendTo(s Sub, m *Message) error {
+	if m.stats != nil {
+		m.stats.delivered.Inc()
+		if !m.Retained {
+			m.stats.latency.Observe(time.Since(m.enqueued).Seconds())
+		}
+	}
+
+	return s.Send(m)
+}
+
+// Depther is implemented by destinations that hold on to messages.
+type Depther interface {
+	Depth() int
+}
+
+// DestInfo is a snapshot of a destination for admin tools.
+type DestInfo struct {
+	Id DestId `json:"name"`
+
+	// One of "queue", "topic", "virtual-topic" or "forward".
+	Type string `json:"type"`
+
+	Temp        bool `json:"temp"`
+	Depth       int  `json:"depth"`
+	Subscribers int  `json:"subscribers"`
+
+	// Messages sent to the destination, and how many a second over
+	// the last minute.
+	Enqueued    uint64  `json:"enqueued"`
+	EnqueueRate float64 `json:"enqueue-rate"`
+
+	// Deliveries to subscribers, and what they did with them.
+	Delivered uint64 `json:"delivered"`
+	Acked     uint64 `json:"acked"`
+	Nacked    uint64 `json:"nacked"`
+
+	// How long messages waited between being sent and delivered.
+	Latency metrics.HistogramSnapshot `json:"-"`
+
+	Usage UsageStats `json:"usage"`
+}
+
+func destType(d Dest) string {
+	switch d.(type) {
+	case *Queue:
+		return "queue"
+	case *VirtualTopic:
+		return "virtual-topic"
+	case *Broadcast:
+		return "topic"
+	case *Composite:
+		return "forward"
+	}
+
+	return "unknown"
+}
+
+// Describe takes a snapshot of a destination.
+func Describe(id DestId) (DestInfo, error) {
+	e, exists := getEntry(id)
+	if !exists {
+		return DestInfo{}, errors.New("destination doesn't exist")
+	}
+
+	info := DestInfo{Id: id, Type: destType(e.dest), Temp: e.temp}
+
+	if d, ok := e.dest.(Depther); ok {
+		info.Depth = d.Depth()
+	}
+
+	if l, ok := e.dest.(SubLister); ok {
+		info.Subscribers = len(l.Subs())
+	}
+
+	info.Enqueued = e.stats.enqueued.total()
+	info.EnqueueRate = e.stats.enqueued.rate()
+	info.Delivered = e.stats.delivered.Value()
+	info.Acked = e.stats.acked.Value()
+	info.Nacked = e.stats.nacked.Value()
+	info.Latency = e.stats.latency.Snapshot()
+
+	if u := DestUsage(id); u != nil {
+		info.Usage = u.Stats()
+	}
+
+	return info, nil
+}
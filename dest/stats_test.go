@@ -0,0 +1,72 @@
+package dest
+
+import (
+	"goodyear/frame"
+	"testing"
+)
+
+func TestDescribe(t *testing.T) {
+	id := DestId("test/describe")
+	AddDest(id, NewQueue())
+	defer RemoveDest(id)
+
+	for i := 0; i < 3; i++ {
+		Send(id, frame.NewFrame())
+	}
+
+	Subscribe(id, &CreditSub{RecordingSub{t: t}, 0})
+
+	info, err := Describe(id)
+	if err != nil {
+		t.Error("failed to describe", err)
+		t.FailNow()
+	}
+
+	if info.Type != "queue" || info.Depth != 3 || info.Subscribers != 1 || info.Enqueued != 3 {
+		t.Error("description is wrong", info)
+	}
+
+	if info.EnqueueRate != 3.0/60 {
+		t.Error("enqueue rate is wrong", info.EnqueueRate)
+	}
+
+	if _, err := Describe("test/describe-missing"); err == nil {
+		t.Error("missing destinations can't be described")
+	}
+}
+
+func TestBroadcastDepth(t *testing.T) {
+	b := NewBroadcast()
+	b.QueueSize = 10
+	b.Subscribe(&CreditSub{RecordingSub{t: t}, 0})
+	b.Send(NewMessage(frame.NewFrame()))
+
+	if d := b.Depth(); d != 1 {
+		t.Error("broadcast depth should be 1, got", d)
+	}
+}
+
+func TestDeliveryStats(t *testing.T) {
+	id := DestId("test/delivery-stats")
+	AddDest(id, NewQueue())
+	defer RemoveDest(id)
+
+	s := &RecordingSub{t: t}
+	Subscribe(id, s)
+
+	Send(id, frame.NewFrame())
+	Send(id, frame.NewFrame())
+
+	if len(s.msgs) != 2 {
+		t.Error("messages weren't delivered")
+		t.FailNow()
+	}
+
+	Ack(s.msgs[0])
+	Nack(s.msgs[1])
+
+	info, _ := Describe(id)
+	if info.Delivered != 2 || info.Acked != 1 || info.Nacked != 1 || info.Latency.Count != 2 {
+		t.Error("delivery stats are wrong", info)
+	}
+}
@@ -0,0 +1,193 @@
+package dest
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy says what a broadcast does when a subscriber's queue
+// is full.
+type OverflowPolicy int
+
+const (
+	DropOldest OverflowPolicy = iota
+	DropNewest
+	DisconnectConsumer
+	BlockProducer
+)
+
+// Disconnecter is implemented by subscriptions that can be thrown off
+// the broker when they can't keep up.
+type Disconnecter interface {
+	Disconnect(reason string)
+}
+
+// subQueue sits between a broadcast and one of its subscribers, so a
+// subscriber that isn't keeping up only hurts itself.  With no buffer,
+// messages go straight to the subscriber when it has credit, and are
+// dropped when it doesn't.
+type subQueue struct {
+	sub     Sub
+	policy  OverflowPolicy
+	timeout time.Duration
+	usage   *Usage
+
+	msgs chan *Message
+	kick chan struct{}
+	done chan struct{}
+
+	dropped      uint64
+	disconnected sync.Once
+}
+
+func (q *subQueue) push(m *Message) {
+	if q.msgs == nil {
+		if hasCredit(q.sub) {
+			sendTo(q.sub, m)
+		} else {
+			atomic.AddUint64(&q.dropped, 1)
+		}
+
+		return
+	}
+
+	// Account for the message before it's queued, since the queue
+	// can be drained as soon as it's there.
+	q.usage.hold(m)
+
+	// The queue may be closed while we're pushing to it, in which
+	// case whatever we left behind has to go.
+	defer func() {
+		select {
+		case <-q.done:
+			q.purge()
+		default:
+		}
+	}()
+
+	select {
+	case q.msgs <- m:
+		return
+	default:
+	}
+
+	switch q.policy {
+	case DropOldest:
+		for {
+			select {
+			case old := <-q.msgs:
+				q.usage.drop(old)
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+			}
+
+			select {
+			case q.msgs <- m:
+				return
+			default:
+			}
+		}
+
+	case DropNewest:
+		q.usage.drop(m)
+		atomic.AddUint64(&q.dropped, 1)
+
+	case DisconnectConsumer:
+		q.usage.drop(m)
+		atomic.AddUint64(&q.dropped, 1)
+		q.disconnected.Do(func() {
+			log.Warn("disconnecting slow consumer", "queued", len(q.msgs))
+			if d, ok := q.sub.(Disconnecter); ok {
+				d.Disconnect("slow consumer, too many messages queued")
+			}
+		})
+
+	case BlockProducer:
+		var timeout <-chan time.Time
+		if q.timeout > 0 {
+			t := time.NewTimer(q.timeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case q.msgs <- m:
+		case <-timeout:
+			log.Warn("dropped message, consumer didn't make room in time", "timeout", q.timeout)
+			q.usage.drop(m)
+			atomic.AddUint64(&q.dropped, 1)
+		case <-q.done:
+			q.usage.drop(m)
+		}
+	}
+}
+
+func (q *subQueue) run() {
+	for {
+		if !hasCredit(q.sub) {
+			select {
+			case <-q.kick:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		select {
+		case m := <-q.msgs:
+			q.usage.drop(m)
+			sendTo(q.sub, m)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// wake lets the queue know its subscriber may have credit again.
+func (q *subQueue) wake() {
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (q *subQueue) close() {
+	close(q.done)
+	q.purge()
+}
+
+// purge throws away whatever's queued, returning how much there was.
+func (q *subQueue) purge() int {
+	n := 0
+	for {
+		select {
+		case m := <-q.msgs:
+			q.usage.drop(m)
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+func (q *subQueue) queued() int {
+	return len(q.msgs)
+}
+
+func newSubQueue(s Sub, size int, policy OverflowPolicy, timeout time.Duration, usage *Usage) *subQueue {
+	q := &subQueue{}
+	q.sub = s
+	q.policy = policy
+	q.timeout = timeout
+	q.usage = usage
+	q.kick = make(chan struct{}, 1)
+	q.done = make(chan struct{})
+
+	if size > 0 {
+		q.msgs = make(chan *Message, size)
+		go q.run()
+	}
+
+	return q
+}
@@ -0,0 +1,168 @@
+package dest
+
+import (
+	"testing"
+	"time"
+)
+
+type DisconnectSub struct {
+	CreditSub
+	reasons []string
+}
+
+func (s *DisconnectSub) Disconnect(reason string) {
+	s.reasons = append(s.reasons, reason)
+}
+
+func overflowBroadcast(policy OverflowPolicy) (*Broadcast, *DisconnectSub) {
+	b := NewBroadcast()
+	b.QueueSize = 2
+	b.Overflow = policy
+	b.BlockTimeout = 20 * time.Millisecond
+
+	s := &DisconnectSub{CreditSub{RecordingSub{}, 0}, nil}
+	b.Subscribe(s)
+
+	for i := uint64(0); i < 4; i++ {
+		b.Send(testMessage(i, nil, ""))
+	}
+
+	return b, s
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	b, _ := overflowBroadcast(DropNewest)
+
+	stats := b.Stats()
+	if len(stats) != 1 || stats[0].Queued != 2 || stats[0].Dropped != 2 {
+		t.Error("expected two queued and two dropped")
+	}
+
+	if m := <-b.subs[0].msgs; m.Id != 0 {
+		t.Error("the oldest message should have been kept")
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	b, _ := overflowBroadcast(DropOldest)
+
+	stats := b.Stats()
+	if stats[0].Queued != 2 || stats[0].Dropped != 2 {
+		t.Error("expected two queued and two dropped")
+	}
+
+	if m := <-b.subs[0].msgs; m.Id != 2 {
+		t.Error("the newest messages should have been kept")
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	_, s := overflowBroadcast(DisconnectConsumer)
+
+	if len(s.reasons) != 1 {
+		t.Error("the subscriber should have been disconnected once")
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	start := time.Now()
+	b, _ := overflowBroadcast(BlockProducer)
+
+	if time.Since(start) < 40*time.Millisecond {
+		t.Error("the producer should have been blocked")
+	}
+
+	if b.Stats()[0].Dropped != 2 {
+		t.Error("messages should have been dropped after the timeout")
+	}
+}
+
+func TestSubQueueDrains(t *testing.T) {
+	b := NewBroadcast()
+	b.QueueSize = 4
+
+	s := newChanSub()
+	b.Subscribe(s)
+	b.Send(testMessage(0, nil, ""))
+
+	select {
+	case <-s.msgs:
+	case <-time.After(time.Second):
+		t.Error("queued message was never delivered")
+	}
+
+	b.Unsubscribe(s)
+}
+
+func TestBlockedProducerUnsubscribe(t *testing.T) {
+	b := NewBroadcast()
+	b.QueueSize = 1
+	b.Overflow = BlockProducer
+
+	s := &CreditSub{RecordingSub{}, 0}
+	b.Subscribe(s)
+	b.Send(testMessage(0, nil, ""))
+
+	sent := make(chan struct{})
+	go func() {
+		b.Send(testMessage(1, nil, ""))
+		close(sent)
+	}()
+
+	// Give the producer a chance to block.
+	time.Sleep(20 * time.Millisecond)
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		b.Unsubscribe(s)
+		close(unsubscribed)
+	}()
+
+	for _, c := range []chan struct{}{unsubscribed, sent} {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			t.Error("a blocked producer shouldn't hold up unsubscribing")
+			t.FailNow()
+		}
+	}
+
+	if b.Usage().Used() != 0 {
+		t.Error("nothing should be held once the subscriber has gone")
+	}
+}
+
+func TestBlockedSubscribeUnsubscribe(t *testing.T) {
+	b := NewBroadcast()
+	b.QueueSize = 1
+	b.Overflow = BlockProducer
+	b.RetainKey = "key"
+
+	b.Send(testMessage(0, hdr{"retain": "true", "key": "a"}, ""))
+	b.Send(testMessage(1, hdr{"retain": "true", "key": "b"}, ""))
+
+	// The second retained message doesn't fit, so Subscribe blocks.
+	s := &CreditSub{RecordingSub{}, 0}
+	subscribed := make(chan struct{})
+	go func() {
+		b.Subscribe(s)
+		close(subscribed)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		b.Unsubscribe(s)
+		close(unsubscribed)
+	}()
+
+	for _, c := range []chan struct{}{unsubscribed, subscribed} {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			t.Error("a blocked subscribe shouldn't hold up unsubscribing")
+			t.FailNow()
+		}
+	}
+}
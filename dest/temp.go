@@ -0,0 +1,62 @@
+package dest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	TempQueuePrefix       = "/temp-queue/"
+	RemoteTempQueuePrefix = "/remote-temp-queue/"
+)
+
+// IsTempQueue reports whether a destination name is local to the
+// connection using it.
+func IsTempQueue(name string) bool {
+	return strings.HasPrefix(name, TempQueuePrefix) && len(name) > len(TempQueuePrefix)
+}
+
+// TempQueue maps a connection's /temp-queue/<name> onto a globally
+// unique destination, creating the queue the first time it's used.
+// Only the owning connection may subscribe to it.
+func TempQueue(owner int, name string) (DestId, error) {
+	if !IsTempQueue(name) {
+		return "", errors.New("not a temporary queue name")
+	}
+
+	id := DestId(fmt.Sprintf("%s%d.%s", destManager.tempPrefix, owner, name[len(TempQueuePrefix):]))
+
+	if e, exists := getEntry(id); exists && e.temp && e.owner == owner {
+		return id, nil
+	}
+
+	destManager.destsLock.Lock()
+
+	if e, exists := getEntry(id); exists {
+		destManager.destsLock.Unlock()
+
+		if !e.temp || e.owner != owner {
+			return "", errors.New("temporary destination belongs to another connection")
+		}
+
+		return id, nil
+	}
+
+	destManager.setEntry(id, &destEntry{dest: NewQueue(), temp: true, owner: owner, stats: newDestStats()})
+	destManager.destsLock.Unlock()
+
+	notify(Event{DestAdded, id})
+
+	return id, nil
+}
+
+// RemoveOwned deletes every temporary destination belonging to a
+// connection.
+func RemoveOwned(owner int) {
+	for id, e := range destManager.entries() {
+		if e.temp && e.owner == owner {
+			RemoveDest(id)
+		}
+	}
+}
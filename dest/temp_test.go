@@ -0,0 +1,59 @@
+package dest
+
+import (
+	"testing"
+)
+
+type OwnedSub struct {
+	RecordingSub
+	owner int
+}
+
+func (s *OwnedSub) OwnerId() int {
+	return s.owner
+}
+
+func TestTempQueue(t *testing.T) {
+	if _, err := TempQueue(1, "/queue/nope"); err == nil {
+		t.Error("only /temp-queue/ names should be accepted")
+	}
+
+	id, err := TempQueue(1, "/temp-queue/replies")
+	if err != nil {
+		t.Error("failed to create temp queue", err)
+		t.FailNow()
+	}
+
+	if id2, _ := TempQueue(1, "/temp-queue/replies"); id2 != id {
+		t.Error("the same name should map to the same queue")
+	}
+
+	if id2, _ := TempQueue(2, "/temp-queue/replies"); id2 == id {
+		t.Error("different connections should get different queues")
+	}
+
+	if err := Subscribe(id, &OwnedSub{RecordingSub{t: t}, 2}); err == nil {
+		t.Error("another connection shouldn't be able to subscribe")
+	}
+
+	if err := Subscribe(id, &RecordingSub{t: t}); err == nil {
+		t.Error("an unowned subscription shouldn't be able to subscribe")
+	}
+
+	s := &OwnedSub{RecordingSub{t: t}, 1}
+	if err := Subscribe(id, s); err != nil {
+		t.Error("the owner should be able to subscribe", err)
+	}
+
+	Send(id, testMessage(getNextMessageId(), hdr{}, "").Frame)
+	if len(s.msgs) != 1 {
+		t.Error("message wasn't delivered to the temp queue")
+	}
+
+	RemoveOwned(1)
+	if _, exists := getEntry(id); exists {
+		t.Error("temp queue should have been removed")
+	}
+
+	RemoveOwned(2)
+}
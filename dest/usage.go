@@ -0,0 +1,231 @@
+package dest
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrQuotaExceeded = errors.New("memory quota exceeded")
+
+// Usage tracks the bytes held by messages waiting to be delivered.
+// Once the total reaches the high-water mark it's considered blocked,
+// and stays that way until it drains back down to the low-water mark.
+// A high-water mark of zero never blocks.
+//
+// The limit is a hard quota: messages that would take usage past it
+// are refused.  A limit of zero is unlimited.
+//
+// Every destination's Usage also counts towards the global one.
+// Retained messages are counted, since nothing else bounds how many
+// keys a broadcast keeps them for.  Replay buffers are bounded by their
+// own settings and aren't counted.
+//
+// XXX - Once messages are persisted, their storage needs a quota too.
+type Usage struct {
+	parent *Usage
+
+	lock      sync.Mutex
+	used      int64
+	limit     int64
+	highWater int64
+	lowWater  int64
+	blocked   bool
+	unblocked chan struct{}
+}
+
+type UsageStats struct {
+	Used      int64 `json:"used"`
+	Limit     int64 `json:"limit"`
+	HighWater int64 `json:"high-water"`
+	LowWater  int64 `json:"low-water"`
+	Blocked   bool  `json:"blocked"`
+}
+
+func (u *Usage) SetWatermarks(high, low int64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if low > high {
+		low = high
+	}
+
+	u.highWater = high
+	u.lowWater = low
+	u.update()
+}
+
+func (u *Usage) SetLimit(limit int64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.limit = limit
+}
+
+func (u *Usage) Stats() UsageStats {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return UsageStats{u.used, u.limit, u.highWater, u.lowWater, u.blocked}
+}
+
+// CheckQuota returns ErrQuotaExceeded if holding n more bytes would
+// take this usage, or the global one, over its limit.
+func (u *Usage) CheckQuota(n int) error {
+	for x := u; x != nil; x = x.parent {
+		x.lock.Lock()
+		over := x.limit > 0 && x.used+int64(n) > x.limit
+		x.lock.Unlock()
+
+		if over {
+			return ErrQuotaExceeded
+		}
+	}
+
+	return nil
+}
+
+func (u *Usage) Used() int64 {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.used
+}
+
+func (u *Usage) Add(n int) {
+	for x := u; x != nil; x = x.parent {
+		x.lock.Lock()
+		x.used += int64(n)
+		x.update()
+		x.lock.Unlock()
+	}
+}
+
+func (u *Usage) Release(n int) {
+	u.Add(-n)
+}
+
+// hold counts a message the first time anything queues it.
+func (u *Usage) hold(m *Message) {
+	if atomic.AddInt32(&m.holds, 1) == 1 {
+		u.Add(m.Size())
+	}
+}
+
+// drop releases a message once nothing is queueing it.
+func (u *Usage) drop(m *Message) {
+	if atomic.AddInt32(&m.holds, -1) == 0 {
+		u.Release(m.Size())
+	}
+}
+
+// Blocked reports whether this usage, or the global one, is over its
+// high-water mark.
+func (u *Usage) Blocked() bool {
+	return u.waitChan() != nil
+}
+
+// Wait blocks until neither this usage nor the global one is blocked,
+// or until cancel is closed, in which case it returns false.
+func (u *Usage) Wait(cancel <-chan struct{}) bool {
+	for ch := u.waitChan(); ch != nil; ch = u.waitChan() {
+		select {
+		case <-ch:
+		case <-cancel:
+			return false
+		}
+	}
+
+	return true
+}
+
+func (u *Usage) waitChan() chan struct{} {
+	for x := u; x != nil; x = x.parent {
+		x.lock.Lock()
+		blocked, ch := x.blocked, x.unblocked
+		x.lock.Unlock()
+
+		if blocked {
+			return ch
+		}
+	}
+
+	return nil
+}
+
+// Must be called with the lock held.
+func (u *Usage) update() {
+	switch {
+	case !u.blocked && u.highWater > 0 && u.used >= u.highWater:
+		u.blocked = true
+		u.unblocked = make(chan struct{})
+	case u.blocked && (u.highWater == 0 || u.used <= u.lowWater):
+		u.blocked = false
+		close(u.unblocked)
+	}
+}
+
+func newUsage(parent *Usage) *Usage {
+	u := &Usage{}
+	u.parent = parent
+
+	return u
+}
+
+// UsageReporter is implemented by destinations that account for the
+// messages they're holding.
+type UsageReporter interface {
+	Usage() *Usage
+}
+
+// GlobalUsage covers every destination.
+func GlobalUsage() *Usage {
+	return destManager.usage
+}
+
+// DestUsage returns the usage for a destination, or nil if it doesn't
+// track any.
+func DestUsage(id DestId) *Usage {
+	if e, exists := getEntry(id); exists {
+		if r, ok := e.dest.(UsageReporter); ok {
+			return r.Usage()
+		}
+	}
+
+	return nil
+}
+
+// usageFor falls back to the global usage for destinations that don't
+// track their own.
+func usageFor(id DestId) *Usage {
+	if u := DestUsage(id); u != nil {
+		return u
+	}
+
+	return destManager.usage
+}
+
+// Blocked reports whether producers sending to a destination should
+// hold off.
+func Blocked(id DestId) bool {
+	return usageFor(id).Blocked()
+}
+
+// WaitForRoom blocks until a destination is no longer over its
+// high-water mark, or until cancel is closed, in which case it returns
+// false.
+func WaitForRoom(id DestId, cancel <-chan struct{}) bool {
+	return usageFor(id).Wait(cancel)
+}
+
+// Usages returns the stats for every destination that tracks them.
+func Usages() map[DestId]UsageStats {
+	stats := make(map[DestId]UsageStats)
+	for id, e := range destManager.entries() {
+		if r, ok := e.dest.(UsageReporter); ok && r.Usage() != nil {
+			stats[id] = r.Usage().Stats()
+		}
+	}
+
+	return stats
+}
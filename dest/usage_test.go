@@ -0,0 +1,163 @@
+package dest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageWatermarks(t *testing.T) {
+	global := newUsage(nil)
+	u := newUsage(global)
+	u.SetWatermarks(100, 50)
+
+	u.Add(60)
+	if u.Blocked() {
+		t.Error("we shouldn't be blocked under the high-water mark")
+	}
+
+	u.Add(40)
+	if !u.Blocked() {
+		t.Error("we should be blocked at the high-water mark")
+	}
+
+	u.Release(30)
+	if !u.Blocked() {
+		t.Error("we should stay blocked until the low-water mark")
+	}
+
+	u.Release(20)
+	if u.Blocked() {
+		t.Error("we should be unblocked at the low-water mark")
+	}
+
+	if global.Used() != 50 {
+		t.Error("the global usage wasn't updated")
+	}
+}
+
+func TestUsageGlobal(t *testing.T) {
+	global := newUsage(nil)
+	global.SetWatermarks(10, 0)
+	u := newUsage(global)
+
+	u.Add(10)
+	if !u.Blocked() {
+		t.Error("the global high-water mark should block every destination")
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- u.Wait(nil)
+	}()
+
+	select {
+	case <-done:
+		t.Error("we shouldn't have stopped waiting yet")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	u.Release(10)
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("the wait shouldn't have been cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Error("we should have stopped waiting")
+	}
+}
+
+func TestUsageWaitCancel(t *testing.T) {
+	u := newUsage(nil)
+	u.SetWatermarks(10, 0)
+	u.Add(10)
+
+	cancel := make(chan struct{})
+	close(cancel)
+
+	if u.Wait(cancel) {
+		t.Error("a cancelled wait should say so")
+	}
+}
+
+func TestQueueUsage(t *testing.T) {
+	q := NewQueue()
+
+	m := testMessage(getNextMessageId(), nil, "hello")
+	q.Send(m)
+	if q.Usage().Used() != int64(m.Size()) {
+		t.Error("the queued message wasn't accounted for")
+	}
+
+	q.Subscribe(&RecordingSub{t: t})
+	if q.Usage().Used() != 0 {
+		t.Error("the delivered message wasn't released")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	id := DestId("test/quota")
+	q := NewQueue()
+	AddDest(id, q)
+	defer RemoveDest(id)
+
+	f := testMessage(0, nil, "0123456789").Frame
+	size := NewMessage(f).Size()
+	q.Usage().SetLimit(int64(size * 2))
+
+	for i := 0; i < 2; i++ {
+		if err := Send(id, f); err != nil {
+			t.Error("send under the quota failed", err)
+		}
+	}
+
+	if err := Send(id, f); err != ErrQuotaExceeded {
+		t.Error("send over the quota should have been refused")
+	}
+
+	if q.Depth() != 2 {
+		t.Error("the refused message shouldn't have been queued")
+	}
+
+	if stats := Usages()[id]; stats.Used != int64(size*2) || stats.Limit != int64(size*2) {
+		t.Error("usage stats are wrong")
+	}
+}
+
+func TestBroadcastUsageCountsOnce(t *testing.T) {
+	b := NewBroadcast()
+	b.QueueSize = 4
+
+	b.Subscribe(&CreditSub{RecordingSub{t: t}, 0})
+	b.Subscribe(&CreditSub{RecordingSub{t: t}, 0})
+
+	m := testMessage(getNextMessageId(), nil, "hello")
+	b.Send(m)
+
+	if b.Usage().Used() != int64(m.Size()) {
+		t.Error("a message queued twice should only be counted once")
+	}
+}
+
+func TestRetainedUsage(t *testing.T) {
+	b := NewBroadcast()
+	b.RetainKey = "key"
+
+	a := testMessage(getNextMessageId(), hdr{"retain": "true", "key": "a"}, "hello")
+	b.Send(a)
+	b.Send(testMessage(getNextMessageId(), hdr{"retain": "true", "key": "b"}, "hello"))
+	if b.Usage().Used() != 2*int64(a.Size()) {
+		t.Error("retained messages should be counted", b.Usage().Used())
+	}
+
+	b.Send(testMessage(getNextMessageId(), hdr{"retain": "true", "key": "a"}, "hello, again"))
+	if b.Usage().Used() != 2*int64(a.Size())+7 {
+		t.Error("a replaced retained message should be released", b.Usage().Used())
+	}
+
+	b.Purge()
+	if b.Usage().Used() != 0 {
+		t.Error("purged retained messages should be released", b.Usage().Used())
+	}
+}
@@ -0,0 +1,116 @@
+package dest
+
+import (
+	"strings"
+)
+
+const (
+	VirtualTopicPrefix  = "/topic/VirtualTopic."
+	ConsumerQueuePrefix = "/queue/Consumer."
+)
+
+// virtualTopicFor works out which virtual topic a consumer queue,
+// /queue/Consumer.<group>.VirtualTopic.<name>, is fed by.
+func virtualTopicFor(id DestId) (DestId, bool) {
+	s := string(id)
+	if !strings.HasPrefix(s, ConsumerQueuePrefix) {
+		return "", false
+	}
+
+	rest := s[len(ConsumerQueuePrefix):]
+	i := strings.Index(rest, ".VirtualTopic.")
+	if i <= 0 || i+len(".VirtualTopic.") == len(rest) {
+		return "", false
+	}
+
+	return DestId("/topic/" + rest[i+1:]), true
+}
+
+// IsVirtualTopic reports whether publishing to a destination should
+// also feed consumer queues.
+func IsVirtualTopic(id DestId) bool {
+	return strings.HasPrefix(string(id), VirtualTopicPrefix) && len(id) > len(VirtualTopicPrefix)
+}
+
+// VirtualTopic is a topic whose messages also go to every consumer
+// queue for it.  Each consumer group gets its own queue, and the
+// subscribers within a group share that queue's messages, so groups
+// scale out independently.  Subscribing to the topic itself works like
+// any other topic.
+type VirtualTopic struct {
+	*Broadcast
+	id DestId
+}
+
+func (vt *VirtualTopic) Send(m *Message) error {
+	err := vt.Broadcast.Send(m)
+
+	for _, q := range consumerQueues(vt.id) {
+		// Each queue accounts for its own copy, and has its own
+		// quota and duplicate detection, like a composite's
+		// forwards.
+		qm := m.copy()
+		ok, err := admit(q, qm)
+		if err == nil && ok {
+			err = deliver(q, qm)
+		}
+
+		if err != nil {
+			log.Warn("failed to copy message to consumer queue", "message", m.Id, "destination", q, "err", err)
+		}
+	}
+
+	return err
+}
+
+func NewVirtualTopic(id DestId) *VirtualTopic {
+	vt := &VirtualTopic{}
+	vt.Broadcast = NewBroadcast()
+	vt.id = id
+
+	return vt
+}
+
+func consumerQueues(topic DestId) []DestId {
+	var ids []DestId
+	for _, id := range List(ConsumerQueuePrefix) {
+		if t, ok := virtualTopicFor(id); ok && t == topic {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// autoCreate makes destinations that spring into existence on first
+// use: virtual topics, and the consumer queues that hang off them.
+func autoCreate(id DestId) (*destEntry, bool) {
+	var d Dest
+
+	switch {
+	case IsVirtualTopic(id):
+		d = NewVirtualTopic(id)
+	default:
+		if _, ok := virtualTopicFor(id); !ok {
+			return nil, false
+		}
+		d = NewQueue()
+	}
+
+	destManager.destsLock.Lock()
+
+	// Someone may have beaten us to it.
+	if e, exists := getEntry(id); exists {
+		destManager.destsLock.Unlock()
+		return e, true
+	}
+
+	e := &destEntry{dest: d, stats: newDestStats()}
+	destManager.setEntry(id, e)
+	destManager.destsLock.Unlock()
+
+	log.Debug("created destination on first use", "destination", id)
+	notify(Event{DestAdded, id})
+
+	return e, true
+}
@@ -0,0 +1,84 @@
+package dest
+
+import (
+	"testing"
+)
+
+func TestVirtualTopicFor(t *testing.T) {
+	cases := map[DestId]DestId{
+		"/queue/Consumer.A.VirtualTopic.Orders":    "/topic/VirtualTopic.Orders",
+		"/queue/Consumer.B.VirtualTopic.Orders.EU": "/topic/VirtualTopic.Orders.EU",
+		"/queue/Consumer..VirtualTopic.Orders":     "",
+		"/queue/Consumer.A.VirtualTopic.":          "",
+		"/queue/Orders":                            "",
+	}
+
+	for q, expected := range cases {
+		topic, ok := virtualTopicFor(q)
+		if ok != (expected != "") || topic != expected {
+			t.Errorf("wrong virtual topic for %s", q)
+		}
+	}
+}
+
+func TestVirtualTopic(t *testing.T) {
+	topic := DestId("/topic/VirtualTopic.Test")
+	defer RemoveDest(topic)
+	defer RemoveDest("/queue/Consumer.A.VirtualTopic.Test")
+	defer RemoveDest("/queue/Consumer.B.VirtualTopic.Test")
+
+	a1 := &RecordingSub{t: t}
+	a2 := &RecordingSub{t: t}
+	b1 := &RecordingSub{t: t}
+	direct := &RecordingSub{t: t}
+
+	Subscribe("/queue/Consumer.A.VirtualTopic.Test", a1)
+	Subscribe("/queue/Consumer.A.VirtualTopic.Test", a2)
+	Subscribe("/queue/Consumer.B.VirtualTopic.Test", b1)
+	Subscribe(topic, direct)
+
+	for i := 0; i < 4; i++ {
+		Send(topic, testMessage(0, nil, "hi").Frame)
+	}
+
+	if len(a1.msgs) != 2 || len(a2.msgs) != 2 {
+		t.Error("group A should have shared the messages")
+	}
+
+	if len(b1.msgs) != 4 {
+		t.Error("group B should have seen every message")
+	}
+
+	if len(direct.msgs) != 4 {
+		t.Error("direct topic subscribers should see every message")
+	}
+
+	// Consumer queues hang on to messages while their group is away.
+	Unsubscribe("/queue/Consumer.B.VirtualTopic.Test", b1)
+	Send(topic, testMessage(0, nil, "hi").Frame)
+
+	d, _ := Lookup("/queue/Consumer.B.VirtualTopic.Test")
+	q := d.(*Queue)
+	if q.Depth() != 1 {
+		t.Error("the message should be waiting for group B")
+	}
+}
+
+func TestVirtualTopicQuota(t *testing.T) {
+	topic := DestId("/topic/VirtualTopic.Quota")
+	queue := DestId("/queue/Consumer.A.VirtualTopic.Quota")
+	defer RemoveDest(topic)
+	defer RemoveDest(queue)
+
+	full := NewQueue()
+	full.Usage().SetLimit(1)
+	AddDest(queue, full)
+
+	if err := Send(topic, testMessage(0, nil, "hi").Frame); err != nil {
+		t.Error("the topic should still take the message", err)
+	}
+
+	if full.Depth() != 0 {
+		t.Error("a consumer queue over its quota shouldn't get a copy")
+	}
+}
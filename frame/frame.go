@@ -5,10 +5,29 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
 
+// Errors for frames that don't parse.
+var (
+	ErrNoDelimiter    = errors.New("no key/value delimiter found.")
+	ErrContentLength  = errors.New("invalid content-length")
+	ErrShortBody      = errors.New("couldn't read frame body")
+	ErrBodyTerminator = errors.New("body incorrectly null terminated")
+	ErrTooLarge       = errors.New("frame too large")
+)
+
+// Limits bounds the frames NewFrameFromReaderLimited will read.  Zero
+// means no limit.
+//
+// XXX - Header lines aren't limited in length yet.
+type Limits struct {
+	MaxHeaders  int
+	MaxBodySize int
+}
+
 func readLine(r *bufio.Reader) (s string, err error) {
 	s, err = r.ReadString('\n')
 	if err != nil {
@@ -48,13 +67,14 @@ type Frame struct {
 	Body     []byte
 }
 
-func (f *Frame) readPreface(r *bufio.Reader) error {
+func (f *Frame) readPreface(r *bufio.Reader, l Limits) error {
 	var (
 		s   string
 		err error
 	)
 
 	var done bool
+	var headers int
 
 	// Consume any newlines that might have come
 	// in after a previous null.
@@ -90,8 +110,14 @@ func (f *Frame) readPreface(r *bufio.Reader) error {
 
 		i := strings.IndexByte(s, ':')
 		if i < 0 {
-			return errors.New("no key/value delimiter found.")
+			return ErrNoDelimiter
+		}
+
+		headers++
+		if l.MaxHeaders > 0 && headers > l.MaxHeaders {
+			return ErrTooLarge
 		}
+
 		k := s[:i]
 		v := s[i+1:]
 		f.Headers.Add(k, v)
@@ -100,11 +126,8 @@ func (f *Frame) readPreface(r *bufio.Reader) error {
 	return nil
 }
 
-func (f *Frame) readBody(r *bufio.Reader) error {
-	var (
-		err error
-		s   string
-	)
+func (f *Frame) readBody(r *bufio.Reader, l Limits) error {
+	var err error
 
 	if val, exists := f.Headers["content-length"]; exists {
 		var (
@@ -112,35 +135,47 @@ func (f *Frame) readBody(r *bufio.Reader) error {
 			c byte
 		)
 
-		if v, err = strconv.Atoi(val[0]); err != nil {
-			return err
+		if v, err = strconv.Atoi(val[0]); err != nil || v < 0 {
+			return ErrContentLength
 		}
 
-		b := make([]byte, v)
-		var count int
-
-		count, err = r.Read(b)
-		if err != nil {
-			return err
+		if l.MaxBodySize > 0 && v > l.MaxBodySize {
+			return ErrTooLarge
 		}
 
-		if count != v {
-			return errors.New("couldn't read frame body")
+		// The body can arrive in pieces.
+		b := make([]byte, v)
+		if _, err = io.ReadFull(r, b); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return ErrShortBody
+			}
+			return err
 		}
 
 		if c, err = r.ReadByte(); err != nil || c != '\x00' {
-			return errors.New("body incorrectly null terminated")
+			return ErrBodyTerminator
 		}
 
 		f.Body = b
 	} else {
-		s, err = r.ReadString('\000')
-		if err != nil {
-			return err
+		var b []byte
+		for {
+			chunk, err := r.ReadSlice('\000')
+			if err != nil && err != bufio.ErrBufferFull {
+				return err
+			}
+
+			b = append(b, chunk...)
+			if l.MaxBodySize > 0 && len(b) > l.MaxBodySize+1 {
+				return ErrTooLarge
+			}
+
+			if err == nil {
+				break
+			}
 		}
 
-		s = s[:len(s)-1]
-		f.Body = []byte(s)
+		f.Body = b[:len(b)-1]
 	}
 
 	f.Complete = true
@@ -203,12 +238,18 @@ func NewFrame() *Frame {
 	return f
 }
 func NewFrameFromReader(r *bufio.Reader) (f *Frame, err error) {
+	return NewFrameFromReaderLimited(r, Limits{})
+}
+
+// NewFrameFromReaderLimited reads a frame, failing with ErrTooLarge if
+// it goes over the limits.
+func NewFrameFromReaderLimited(r *bufio.Reader, l Limits) (f *Frame, err error) {
 	f = NewFrame()
-	if err = f.readPreface(r); err != nil {
+	if err = f.readPreface(r, l); err != nil {
 		return
 	}
 
-	if err = f.readBody(r); err != nil {
+	if err = f.readBody(r, l); err != nil {
 		return
 	}
 
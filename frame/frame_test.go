@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func _F(s string) string {
@@ -180,3 +181,55 @@ c:stuff
 		t.Error("we didn't get the header value we expected.")
 	}
 }
+
+func TestBodyInPieces(t *testing.T) {
+	s := _F(_N(`SEND
+content-length:11
+
+hello world`))
+	r := bufio.NewReader(iotest.OneByteReader(strings.NewReader(s)))
+
+	f, err := NewFrameFromReader(r)
+	if err != nil {
+		t.Error("didn't parse", err)
+		t.FailNow()
+	}
+
+	if string(f.Body) != "hello world" {
+		t.Error("we didn't read the whole body.")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	l := Limits{MaxHeaders: 2, MaxBodySize: 4}
+
+	if _, err := NewFrameFromReaderLimited(_FR(_N(`SEND
+a:1
+b:2
+
+abcd`)), l); err != nil {
+		t.Error("a frame within the limits should parse", err)
+	}
+
+	if _, err := NewFrameFromReaderLimited(_FR(_N(`SEND
+a:1
+b:2
+c:3
+
+`)), l); err != ErrTooLarge {
+		t.Error("too many headers should be refused", err)
+	}
+
+	if _, err := NewFrameFromReaderLimited(_FR(_N(`SEND
+content-length:5
+
+abcde`)), l); err != ErrTooLarge {
+		t.Error("too long a content-length should be refused", err)
+	}
+
+	if _, err := NewFrameFromReaderLimited(_FR(_N(`SEND
+
+abcde`)), l); err != ErrTooLarge {
+		t.Error("too long a body should be refused", err)
+	}
+}
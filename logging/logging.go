@@ -0,0 +1,159 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The subsystems that have their own verbosity.  Frame covers every
+// frame a connection sends or receives, Dest the destinations, and
+// Server connections and the broker itself.
+const (
+	Frame  = "frame"
+	Dest   = "dest"
+	Server = "server"
+)
+
+var subsystems = []string{Frame, Dest, Server}
+
+// levelHandler drops records below its subsystem's level before they
+// get to the shared handler.
+type levelHandler struct {
+	level *slog.LevelVar
+	h     slog.Handler
+}
+
+func (lh *levelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= lh.level.Level()
+}
+
+func (lh *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return lh.h.Handle(ctx, r)
+}
+
+func (lh *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{lh.level, lh.h.WithAttrs(attrs)}
+}
+
+func (lh *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{lh.level, lh.h.WithGroup(name)}
+}
+
+var (
+	base    slog.Handler
+	levels  map[string]*slog.LevelVar
+	loggers map[string]*slog.Logger
+
+	// What the levels were before ToggleDebug, if it's on.
+	levelsLock sync.Mutex
+	saved      map[string]slog.Level
+)
+
+func init() {
+	base = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	levels = make(map[string]*slog.LevelVar)
+	loggers = make(map[string]*slog.Logger)
+
+	for _, s := range subsystems {
+		levels[s] = &slog.LevelVar{}
+		loggers[s] = slog.New(&levelHandler{levels[s], base}).With("subsystem", s)
+	}
+}
+
+// Logger returns the logger for a subsystem.
+func Logger(subsystem string) *slog.Logger {
+	return loggers[subsystem]
+}
+
+// ParseLevel understands "debug", "info", "warn" and "error".
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("unknown log level '%s'", s)
+	}
+
+	return l, nil
+}
+
+// SetLevel changes how verbose a subsystem is.
+func SetLevel(subsystem string, l slog.Level) error {
+	lv, exists := levels[subsystem]
+	if !exists {
+		return fmt.Errorf("unknown log subsystem '%s'", subsystem)
+	}
+
+	levelsLock.Lock()
+	saved = nil
+	levelsLock.Unlock()
+
+	lv.Set(l)
+
+	return nil
+}
+
+// SetLevels sets levels by name, e.g. from a config file.  Nothing is
+// changed unless they're all good.
+func SetLevels(named map[string]string) error {
+	parsed := make(map[string]slog.Level)
+	for s, name := range named {
+		if _, exists := levels[s]; !exists {
+			return fmt.Errorf("unknown log subsystem '%s'", s)
+		}
+
+		l, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		parsed[s] = l
+	}
+
+	for s, l := range parsed {
+		SetLevel(s, l)
+	}
+
+	return nil
+}
+
+// Levels returns every subsystem's level by name.
+func Levels() map[string]string {
+	named := make(map[string]string)
+	for s, lv := range levels {
+		named[s] = strings.ToLower(lv.Level().String())
+	}
+
+	return named
+}
+
+// Subsystems lists the subsystems, sorted.
+func Subsystems() []string {
+	s := append([]string{}, subsystems...)
+	sort.Strings(s)
+
+	return s
+}
+
+// ToggleDebug turns on debug logging everywhere, or puts the levels
+// back to what they were if it's already on.
+func ToggleDebug() {
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
+
+	if saved != nil {
+		for s, l := range saved {
+			levels[s].Set(l)
+		}
+		saved = nil
+		return
+	}
+
+	saved = make(map[string]slog.Level)
+	for s, lv := range levels {
+		saved[s] = lv.Level()
+		lv.Set(slog.LevelDebug)
+	}
+}
@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	defer SetLevel(Dest, slog.LevelInfo)
+
+	ctx := context.Background()
+	if Logger(Dest).Enabled(ctx, slog.LevelDebug) {
+		t.Error("debug should be off by default")
+	}
+
+	if err := SetLevel(Dest, slog.LevelDebug); err != nil {
+		t.Error("failed to set level", err)
+	}
+
+	if !Logger(Dest).Enabled(ctx, slog.LevelDebug) || Logger(Frame).Enabled(ctx, slog.LevelDebug) {
+		t.Error("levels should be per subsystem")
+	}
+
+	if Levels()[Dest] != "debug" {
+		t.Error("levels by name are wrong", Levels())
+	}
+
+	if err := SetLevel("blarg", slog.LevelDebug); err == nil {
+		t.Error("unknown subsystems should be refused")
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	defer SetLevels(map[string]string{Frame: "info", Server: "info"})
+
+	if err := SetLevels(map[string]string{Frame: "debug", Server: "loud"}); err == nil {
+		t.Error("bad levels should be refused")
+	}
+
+	if Levels()[Frame] != "info" {
+		t.Error("nothing should change when a level is bad")
+	}
+
+	if err := SetLevels(map[string]string{Frame: "debug", Server: "warn"}); err != nil {
+		t.Error("failed to set levels", err)
+	}
+
+	if Levels()[Frame] != "debug" || Levels()[Server] != "warn" {
+		t.Error("levels weren't set", Levels())
+	}
+}
+
+func TestToggleDebug(t *testing.T) {
+	SetLevel(Server, slog.LevelWarn)
+	defer SetLevel(Server, slog.LevelInfo)
+
+	ToggleDebug()
+	if Levels()[Server] != "debug" || Levels()[Dest] != "debug" {
+		t.Error("debug should be on everywhere", Levels())
+	}
+
+	ToggleDebug()
+	if Levels()[Server] != "warn" || Levels()[Dest] != "info" {
+		t.Error("levels should have been put back", Levels())
+	}
+}
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter only ever goes up.
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// CounterVec is a set of counters told apart by the value of a single
+// label.
+type CounterVec struct {
+	lock     sync.RWMutex
+	counters map[string]*Counter
+}
+
+func NewCounterVec() *CounterVec {
+	v := &CounterVec{}
+	v.counters = make(map[string]*Counter)
+
+	return v
+}
+
+// With returns the counter for a label value, creating it if need be.
+func (v *CounterVec) With(value string) *Counter {
+	v.lock.RLock()
+	c, exists := v.counters[value]
+	v.lock.RUnlock()
+
+	if exists {
+		return c
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if c, exists = v.counters[value]; !exists {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+
+	return c
+}
+
+// Values returns every label value and its count, sorted by value.
+func (v *CounterVec) Values() ([]string, []uint64) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	labels := make([]string, 0, len(v.counters))
+	for l := range v.counters {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	counts := make([]uint64, len(labels))
+	for i, l := range labels {
+		counts[i] = v.counters[l].Value()
+	}
+
+	return labels, counts
+}
+
+// Bucket upper bounds for latencies, in seconds.
+var LatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+// Histogram counts observations into buckets by their upper bounds.
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramSnapshot has cumulative counts, one for each bound.
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	h := &Histogram{}
+	h.bounds = bounds
+	h.counts = make([]uint64, len(bounds))
+
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := HistogramSnapshot{h.bounds, make([]uint64, len(h.counts)), h.sum, h.count}
+
+	var total uint64
+	for i, n := range h.counts {
+		total += n
+		s.Counts[i] = total
+	}
+
+	return s
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, l.Name, labelEscaper.Replace(l.Value))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writer writes metrics in the Prometheus text format.  Every sample
+// of a metric has to be written before moving on to the next one.
+type Writer struct {
+	w    io.Writer
+	last string
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) describe(name, help, kind string) {
+	if name == w.last {
+		return
+	}
+
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	w.last = name
+}
+
+func (w *Writer) sample(name string, v float64, labels []Label) {
+	fmt.Fprintf(w.w, "%s%s %s\n", name, formatLabels(labels), formatValue(v))
+}
+
+func (w *Writer) Counter(name, help string, v uint64, labels ...Label) {
+	w.describe(name, help, "counter")
+	w.sample(name, float64(v), labels)
+}
+
+func (w *Writer) Gauge(name, help string, v float64, labels ...Label) {
+	w.describe(name, help, "gauge")
+	w.sample(name, v, labels)
+}
+
+func (w *Writer) Histogram(name, help string, s HistogramSnapshot, labels ...Label) {
+	w.describe(name, help, "histogram")
+
+	le := append(labels[:len(labels):len(labels)], Label{"le", ""})
+	for i, b := range s.Bounds {
+		le[len(le)-1].Value = formatValue(b)
+		w.sample(name+"_bucket", float64(s.Counts[i]), le)
+	}
+	le[len(le)-1].Value = "+Inf"
+	w.sample(name+"_bucket", float64(s.Count), le)
+
+	w.sample(name+"_sum", s.Sum, labels)
+	w.sample(name+"_count", float64(s.Count), labels)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	v := NewCounterVec()
+	v.With("SEND").Inc()
+	v.With("SEND").Add(2)
+	v.With("ACK").Inc()
+
+	labels, counts := v.Values()
+	if len(labels) != 2 || labels[0] != "ACK" || counts[0] != 1 || labels[1] != "SEND" || counts[1] != 3 {
+		t.Error("counts are wrong", labels, counts)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(1)
+	h.Observe(3)
+	h.Observe(10)
+
+	s := h.Snapshot()
+	if s.Counts[0] != 2 || s.Counts[1] != 3 || s.Count != 4 || s.Sum != 14.5 {
+		t.Error("histogram is wrong", s)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	w.Counter("frames_total", "Frames.", 3, Label{"command", "SEND"})
+	w.Counter("frames_total", "Frames.", 1, Label{"command", `a"b`})
+	w.Gauge("depth", "Depth.", 2)
+
+	h := NewHistogram([]float64{1})
+	h.Observe(0.5)
+	w.Histogram("latency_seconds", "Latency.", h.Snapshot(), Label{"destination", "q"})
+
+	expected := `# HELP frames_total Frames.
+# TYPE frames_total counter
+frames_total{command="SEND"} 3
+frames_total{command="a\"b"} 1
+# HELP depth Depth.
+# TYPE depth gauge
+depth 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{destination="q",le="1"} 1
+latency_seconds_bucket{destination="q",le="+Inf"} 1
+latency_seconds_sum{destination="q"} 0.5
+latency_seconds_count{destination="q"} 1
+`
+
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
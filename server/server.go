@@ -1,89 +1,140 @@
 package main
 
 import (
-	"bufio"
-	"container/list"
-	"goodyear/frame"
-	// XXX - We need to not use this directly,
-	// since we need to support levels.
+	"context"
+	"flag"
+	"goodyear/broker"
 	"goodyear/dest"
-	"log"
-	"net"
-	"sync"
+	"goodyear/logging"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-type serverState struct {
-	connsLock sync.RWMutex
-	conns     *list.List
-	serial    int
-}
+const defaultShutdownTimeout = 30 * time.Second
+
+var log = logging.Logger(logging.Server)
 
-const LISTENING_ADDR = ":61613"
+func fatal(err error) {
+	log.Error(err.Error())
+	os.Exit(1)
+}
 
 func main() {
-	state := serverState{}
-	state.serial = 0
-	state.conns = list.New()
+	configPath := flag.String("config", "", "JSON configuration file")
+	flag.Parse()
 
-	d := dest.NewBroadcast()
-	dest.AddDest("everyone", d)
+	cfg := broker.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = broker.LoadConfig(*configPath); err != nil {
+			fatal(err)
+		}
+	}
 
-	log.Print("Listening on address ", LISTENING_ADDR)
-	l, err := net.Listen("tcp", LISTENING_ADDR)
-	if err != nil {
-		log.Fatal(err)
+	shutdownTimeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout != "" {
+		var err error
+		if shutdownTimeout, err = time.ParseDuration(cfg.ShutdownTimeout); err != nil {
+			fatal(err)
+		}
+	}
+
+	b := broker.NewBroker()
+	b.Config = cfg
+	if err := b.Start(); err != nil {
+		fatal(err)
 	}
-	defer l.Close()
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal(err)
+
+	// SIGUSR1 turns debug logging on and off.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	go func() {
+		for range usr1 {
+			logging.ToggleDebug()
+			log.Info("toggled debug logging", "levels", logging.Levels())
 		}
-		cs := newClientState(state.serial)
-		state.serial += 1
-		state.connsLock.Lock()
-		thisConn := state.conns.PushBack(cs)
-		state.connsLock.Unlock()
-		log.Printf("accepting connection %d", cs.id)
-
-		// Outgoing Frames
-		go func(conn net.Conn, cs *clientState, myElement *list.Element) {
-			defer func() {
-				log.Print("taking down conn ", cs.id)
-				state.connsLock.Lock()
-				state.conns.Remove(myElement)
-				state.connsLock.Unlock()
-				conn.Close()
-			}()
-
-			for f := range cs.outgoing {
-				b := f.Bytes()
-				n, err := conn.Write(b)
+	}()
+
+	// Access control and log levels can be changed without a restart.
+	if *configPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		go func() {
+			for range hup {
+				cfg, err := broker.LoadConfig(*configPath)
+				if err == nil {
+					err = b.Reload(cfg)
+				}
 
 				if err != nil {
-					log.Printf("Error writing to conn %d: %s", cs.id, err)
-					cs.phase = errorPhase
-				} else if n != len(b) {
-					log.Printf("Short write while sending to client conn %d", cs.id)
-					cs.phase = errorPhase
+					log.Error("failed to reload config", "err", err)
+					continue
 				}
+
+				log.Info("reloaded config", "path", *configPath)
 			}
-		}(conn, cs, thisConn)
+		}()
+	}
 
-		// Incoming Frame Processing
-		go func(conn net.Conn, cs *clientState) {
-			r := bufio.NewReader(conn)
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
 
-			getFrame := func() *frame.Frame {
-				f, err := frame.NewFrameFromReader(r)
-				if err == nil {
-					return f
-				}
-				log.Printf("Failed parsing frame: %s", err)
-				return nil
+	go func() {
+		if err := b.ListenAndServe(); err != broker.ErrBrokerClosed {
+			fatal(err)
+		}
+	}()
+
+	// The admin API and metrics can share an address.
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if cfg.AdminAddr != "" {
+		mux(cfg.AdminAddr).Handle("/", b.AdminHandler())
+	}
+
+	if cfg.MetricsAddr != "" {
+		mux(cfg.MetricsAddr).Handle("/metrics", b.MetricsHandler())
+	}
+
+	var httpServers []*http.Server
+	for addr, m := range muxes {
+		srv := &http.Server{Addr: addr, Handler: m}
+		httpServers = append(httpServers, srv)
+
+		log.Info("HTTP listening", "addr", addr)
+		go func(srv *http.Server) {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				fatal(err)
 			}
+		}(srv)
+	}
+
+	sig := <-term
+	log.Info("shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := b.Shutdown(ctx); err != nil {
+		log.Warn("shutdown didn't finish", "err", err)
+	}
+
+	for _, srv := range httpServers {
+		srv.Shutdown(ctx)
+	}
 
-			cs.HandleIncomingFrames(getFrame)
-		}(conn, cs)
+	if n := dest.Shutdown(); n > 0 {
+		log.Warn("dropped scheduled messages", "count", n)
 	}
 }